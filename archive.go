@@ -0,0 +1,704 @@
+package hpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Archive is an HPI file whose header has been read and whose directory
+// has been decrypted into memory. It is the read side of the package: none
+// of its methods write to the file, which is only ever read through its
+// io.ReadSeeker. Archives are created with Writer instead.
+type Archive struct {
+	Options ExtractOptions
+
+	r         io.ReadSeeker
+	ra        io.ReaderAt // r itself when it supports ReadAt.
+	header    Header
+	key       byte
+	dir       []byte // Padded with Start zero bytes so offsets match the file.
+	dirOnce   sync.Once
+	dirErr    error
+	chunkSize int          // Decompressed size of a full chunk.
+	unmap     func() error // Releases the mapping of an Archive from OpenMmap.
+	base      int64        // Where the archive starts in r's file, as given to OpenAt.
+}
+
+// Open reads the header of an HPI file and decrypts its directory.
+func Open(r io.ReadSeeker) (*Archive, error) {
+	a, err := OpenLazy(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.loadDirectory(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// OpenAt opens an HPI archive that begins offset bytes into r, whose size
+// is size, such as one appended to another file. The offsets stored in the
+// archive are relative to its own start, so every read is shifted by
+// offset. FindArchiveOffset finds offset when it is not known. The free
+// functions accept io.NewSectionReader(r, offset, size-offset) the same way.
+func OpenAt(r io.ReaderAt, offset, size int64) (*Archive, error) {
+	if offset < 0 || offset > size {
+		return nil, fmt.Errorf("archive offset %d is outside the %d-byte file", offset, size)
+	}
+	a, err := Open(io.NewSectionReader(r, offset, size-offset))
+	if err != nil {
+		return nil, err
+	}
+	a.base = offset
+	return a, nil
+}
+
+// OpenLazy reads the header of an HPI file but leaves its directory on
+// disk. Looking up a single file by name, as FirstChunk and ExtractChunks
+// do, then decrypts only the directory nodes along its path,
+// which keeps reading one file from a very large archive cheap. The cost is
+// that each such lookup reads the file again, with several small reads per
+// path component, where an Archive from Open resolves every lookup in
+// memory. Anything that needs the whole directory, such as listing or
+// extracting the archive, loads and keeps it on first use, after which the
+// Archive behaves as if it came from Open.
+func OpenLazy(r io.ReadSeeker) (*Archive, error) {
+	var header Header
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("not an HPI archive: reading header: %w", err)
+	}
+	if err := ValidateHeader(header); err != nil {
+		return nil, err
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if int64(header.DirectorySize) > size {
+		return nil, fmt.Errorf("truncated HPI archive: directory ends at %d, past the end of the %d-byte file", header.DirectorySize, size)
+	}
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		ra = &seekerAt{r: r}
+	}
+	return &Archive{
+		r:         r,
+		ra:        ra,
+		header:    header,
+		key:       header.GetKey(),
+		chunkSize: header.chunkSize(),
+	}, nil
+}
+
+// Header returns the header the archive was opened with, as stored in the
+// file. Archives made by fileArchive for the free functions have none and
+// return the zero Header.
+func (a *Archive) Header() Header {
+	return a.header
+}
+
+// Key returns the key the archive is decrypted with, as calculated by
+// Header.GetKey. It is the key that the free functions, such as
+// TraverseTree, take.
+func (a *Archive) Key() byte {
+	return a.key
+}
+
+// fileArchive returns an Archive for the free functions, which are given
+// the key and a directory that the caller has already decrypted. It has no
+// directory of its own and can only decode files whose FileData is known.
+func fileArchive(r io.ReadSeeker, key byte) *Archive {
+	return &Archive{r: r, ra: &seekerAt{r: r}, key: key, chunkSize: MaxChunkSize}
+}
+
+// loadDirectory decrypts the whole directory into a.dir if that has not
+// been done yet.
+func (a *Archive) loadDirectory() error {
+	a.dirOnce.Do(func() {
+		start := int(a.header.Start)
+		buf, err := ReadAndDecryptAt(a.ra, a.key, int(a.header.DirectorySize)-start, start)
+		if err != nil {
+			a.dirErr = err
+			return
+		}
+		a.dir = append(make([]byte, start), buf...)
+	})
+	return a.dirErr
+}
+
+// FindArchiveOffset scans r for the first HPI header whose directory fits
+// within size bytes, such as the payload of a self-extracting installer. The
+// archive can then be opened with OpenAt(r, off, size).
+func FindArchiveOffset(r io.ReaderAt, size int64) (int64, error) {
+	const blockSize = 64 * 1024
+	var (
+		magic  = []byte{'H', 'A', 'P', 'I'}
+		block  = make([]byte, blockSize+len(magic)-1)
+		header Header
+	)
+	for base := int64(0); base < size; base += blockSize {
+		n, err := r.ReadAt(block, base)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := 0; i < n; {
+			j := bytes.Index(block[i:n], magic)
+			if j < 0 {
+				break
+			}
+			off := base + int64(i+j)
+			i += j + 1
+			raw := make([]byte, binary.Size(header))
+			if _, err := r.ReadAt(raw, off); err != nil {
+				continue
+			}
+			binary.Read(bytes.NewReader(raw), binary.LittleEndian, &header)
+			if ValidateHeader(header) == nil && off+int64(header.DirectorySize) <= size {
+				return off, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no HPI archive found")
+}
+
+// ReadFileAt decrypts and decompresses the file described by fd.
+func (a *Archive) ReadFileAt(fd FileData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := a.decoder().decodeFile(fd, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadEntry reads the FileData at the entry's DirDataOffset and returns the
+// decompressed contents of the file.
+func (a *Archive) ReadEntry(e Entry) ([]byte, error) {
+	if e.Flag == 1 {
+		return nil, fmt.Errorf("entry at %d is a directory", e.DirDataOffset)
+	}
+	fd, err := a.fileData(int(e.DirDataOffset))
+	if err != nil {
+		return nil, err
+	}
+	return a.ReadFileAt(fd)
+}
+
+// ReadAllParallel decompresses every file in the archive into memory using
+// up to workers goroutines, or runtime.NumCPU() if workers is less than one.
+// The map is keyed by the same slash-separated paths that ListWithDepth
+// returns. Memory use is the full decompressed size of the archive, as given
+// by SizeReport, plus one file's stored data per worker. If any file fails,
+// the error for the first such file in directory order is returned.
+func (a *Archive) ReadAllParallel(workers int) (map[string][]byte, error) {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		data = make([][]byte, len(files))
+		errs = make([]error, len(files))
+		d    = a.decoder()
+	)
+	d.timings = nil // Timings is not safe for concurrent use.
+	parallel(len(files), workers, func(i int) {
+		var buf bytes.Buffer
+		buf.Grow(int(files[i].fd.FileSize))
+		if err := d.decodeFile(files[i].fd, &buf); err != nil {
+			errs[i] = fmt.Errorf("%s: %w", files[i].name, err)
+			return
+		}
+		data[i] = buf.Bytes()
+	})
+	all := make(map[string][]byte, len(files))
+	for i, f := range files {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		all[f.name] = data[i]
+	}
+	return all, nil
+}
+
+// List returns the path of every file in the archive in directory order.
+// Directories are not listed; use ListWithDepth for those. A directory that
+// cannot be parsed ends the list early, and Validate reports why.
+func (a *Archive) List() []string {
+	var names []string
+	a.walk(func(name string, _ int, e Entry) error {
+		if e.Flag != 1 {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names
+}
+
+// Extract returns the decompressed contents of the named file.
+func (a *Archive) Extract(name string) ([]byte, error) {
+	f, err := a.find(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := a.ReadFileAt(f.fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return data, nil
+}
+
+// FirstChunk decompresses only the first chunk of the named file. Formats
+// that keep their own table of contents at the start of a file can read it
+// this way without decoding the rest.
+func (a *Archive) FirstChunk(name string) ([]byte, error) {
+	f, err := a.find(name)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := a.decoder().decodeChunks(f.fd, &buf, 1); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// find returns the file stored at name.
+func (a *Archive) find(name string) (archiveFile, error) {
+	if a.dir == nil {
+		return a.lookup(name)
+	}
+	files, err := a.files()
+	if err != nil {
+		return archiveFile{}, err
+	}
+	key := a.pathKey(name)
+	for _, f := range files {
+		if a.pathKey(f.name) == key {
+			return f, nil
+		}
+	}
+	return archiveFile{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+}
+
+// pathKey returns the form of name that lookups compare: name itself if
+// Options.ExactPaths is set and NormalizePath(name) otherwise.
+func (a *Archive) pathKey(name string) string {
+	if a.Options.ExactPaths {
+		return name
+	}
+	return NormalizePath(name)
+}
+
+// lookup is find for an archive whose directory has not been loaded. Only
+// the directory nodes along the path to name are read and decrypted.
+func (a *Archive) lookup(name string) (archiveFile, error) {
+	var (
+		parts  = strings.Split(a.pathKey(name), "/")
+		offset = int(a.header.Start)
+		parent string
+	)
+	for i, part := range parts {
+		entries, names, err := a.streamDirectory(offset)
+		if err != nil {
+			return archiveFile{}, err
+		}
+		entries, names, err = dedupe(parent, entries, names, a.Options.Duplicates)
+		if err != nil {
+			return archiveFile{}, err
+		}
+		j := 0
+		for j < len(names) && a.pathKey(names[j]) != part {
+			j++
+		}
+		last := i == len(parts)-1
+		if j == len(names) || (entries[j].Flag == 1) == last {
+			return archiveFile{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+		}
+		offset = int(entries[j].DirDataOffset)
+		if last {
+			fd, err := a.fileData(offset)
+			if err != nil {
+				return archiveFile{}, fmt.Errorf("%s: %w", name, err)
+			}
+			return archiveFile{name: path.Join(parent, names[j]), fd: fd, offset: offset}, nil
+		}
+		parent = path.Join(parent, names[j])
+	}
+	return archiveFile{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+}
+
+// streamDirectory is sliceDirectory for a directory that has not been
+// loaded, reading and decrypting just the node at offset, its entries and
+// their names.
+func (a *Archive) streamDirectory(offset int) ([]Entry, []string, error) {
+	const entrySize = 9
+	node, err := a.readDirectoryAt(8, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	numEntries := int(binary.LittleEndian.Uint32(node))
+	entryOffset := int(binary.LittleEndian.Uint32(node[4:]))
+	size := int64(a.header.DirectorySize)
+	if err := checkEntryTable(int64(numEntries), int64(entryOffset), size); err != nil {
+		return nil, nil, err
+	}
+	raw, err := a.readDirectoryAt(numEntries*entrySize, entryOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := make([]Entry, numEntries)
+	names := make([]string, numEntries)
+	for i := range entries {
+		entries[i] = Entry{
+			NameOffset:    binary.LittleEndian.Uint32(raw[i*entrySize:]),
+			DirDataOffset: binary.LittleEndian.Uint32(raw[i*entrySize+4:]),
+			Flag:          raw[i*entrySize+8],
+		}
+	}
+	if err := checkEntries(entries, size); err != nil {
+		return nil, nil, err
+	}
+	for i := range entries {
+		if names[i], err = a.readNameAt(int(entries[i].NameOffset)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return entries, names, nil
+}
+
+// readNameAt is readName for a directory that has not been loaded. The name
+// is read in small blocks until its terminating NUL.
+func (a *Archive) readNameAt(offset int) (string, error) {
+	const block = 64
+	var name []byte
+	for {
+		n := int(a.header.DirectorySize) - offset
+		if n > block {
+			n = block
+		}
+		if n <= 0 {
+			return "", fmt.Errorf("%w: name has no terminator", ErrCorruptDirectory)
+		}
+		buf, err := a.readDirectoryAt(n, offset)
+		if err != nil {
+			return "", err
+		}
+		if end := bytes.IndexByte(buf, 0); end >= 0 {
+			return string(append(name, buf[:end]...)), nil
+		}
+		name = append(name, buf...)
+		offset += n
+	}
+}
+
+// readDirectoryAt reads and decrypts size bytes at offset, which must lie
+// within the directory.
+func (a *Archive) readDirectoryAt(size, offset int) ([]byte, error) {
+	if offset < int(a.header.Start) || offset+size > int(a.header.DirectorySize) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return ReadAndDecryptAt(a.ra, a.key, size, offset)
+}
+
+// decoder returns a decoder for the archive's files.
+func (a *Archive) decoder() decoder {
+	return decoder{
+		archive:       a.ra,
+		key:           a.key,
+		chunkSize:     a.chunkSize,
+		verify:        a.Options.VerifyChecksums,
+		timings:       a.Options.Timings,
+		recoverChunks: a.Options.Recover,
+	}
+}
+
+// fileData parses the FileData at offset in the directory.
+func (a *Archive) fileData(offset int) (FileData, error) {
+	var fd FileData
+	if offset < 0 || offset >= int(a.header.DirectorySize) {
+		return fd, fmt.Errorf("file data offset %d is outside the directory", offset)
+	}
+	dir := a.dir
+	if dir == nil {
+		buf, err := a.readDirectoryAt(binary.Size(fd), offset)
+		if err != nil {
+			return fd, err
+		}
+		dir, offset = buf, 0
+	}
+	if err := binary.Read(bytes.NewReader(dir[offset:]), binary.LittleEndian, &fd); err != nil {
+		return fd, err
+	}
+	return fd, nil
+}
+
+// SizeReport returns the size of the backing file and the total size of
+// the archive's contents once decompressed.
+func (a *Archive) SizeReport() (onDisk int64, logical int64, err error) {
+	// The size is found through a.ra, which serializes the seek with
+	// concurrent reads when it wraps a.r. Otherwise a.r has its own
+	// ReadAt, which its offset does not affect.
+	onDisk, ok := archiveSize(a.ra)
+	if !ok {
+		if onDisk, err = a.r.Seek(0, io.SeekEnd); err != nil {
+			return 0, 0, err
+		}
+	}
+	err = a.walk(func(name string, _ int, e Entry) error {
+		if e.Flag == 1 {
+			return nil
+		}
+		fd, err := a.fileData(int(e.DirDataOffset))
+		if err != nil {
+			return err
+		}
+		logical += int64(fd.FileSize)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return onDisk, logical, nil
+}
+
+// Extensions counts the files in the archive by their lowercased extension,
+// such as ".gaf" or ".tdf". Files without an extension are counted under "".
+func (a *Archive) Extensions() (map[string]int, error) {
+	counts := make(map[string]int)
+	err := a.walk(func(name string, _ int, e Entry) error {
+		if e.Flag != 1 {
+			counts[strings.ToLower(path.Ext(name))]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// EstimateWork returns the number of stored bytes that extracting the whole
+// archive reads and decodes, chunk headers included, along with the number
+// of chunks. Only the chunk size tables are read, so it is cheap to call
+// before an extraction to size a progress estimate.
+func (a *Archive) EstimateWork() (bytes int64, chunks int, err error) {
+	files, err := a.files()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, f := range files {
+		sizes, err := a.decoder().chunkSizes(f.fd)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", f.name, err)
+		}
+		for _, size := range sizes {
+			bytes += int64(size)
+		}
+		chunks += len(sizes)
+	}
+	return bytes, chunks, nil
+}
+
+// ChunkEncryptionStats counts the archive's chunks by whether their
+// Encrypted flag is set. Chunk encryption is independent of the key that
+// encrypts the archive as a whole: an archive with a key of 0 can still
+// store encrypted chunks. Only chunk headers are read.
+func (a *Archive) ChunkEncryptionStats() (encrypted, plain int, err error) {
+	files, err := a.files()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, f := range files {
+		headers, err := a.decoder().chunkHeaders(f.fd)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", f.name, err)
+		}
+		for _, h := range headers {
+			if h.Encrypted != 0 {
+				encrypted++
+			} else {
+				plain++
+			}
+		}
+	}
+	return encrypted, plain, nil
+}
+
+// FileInfo describes a file in the archive as stored.
+type FileInfo struct {
+	Path           string
+	Size           uint32 // Decompressed size.
+	Compression    byte   // FileData.Flag, the method the file was written with.
+	CompressedSize uint32 // Sum of the chunks' CompressedSize.
+	Chunks         int
+}
+
+// FileInfos describes every file in the archive in directory order. Only
+// the directory and chunk headers are read.
+func (a *Archive) FileInfos() ([]FileInfo, error) {
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]FileInfo, len(files))
+	for i, f := range files {
+		headers, err := a.decoder().chunkHeaders(f.fd)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+		infos[i] = FileInfo{
+			Path:        f.name,
+			Size:        f.fd.FileSize,
+			Compression: f.fd.Flag,
+			Chunks:      len(headers),
+		}
+		for _, h := range headers {
+			infos[i].CompressedSize += h.CompressedSize
+		}
+	}
+	return infos, nil
+}
+
+// Stats2 returns structural metrics from a walk of the directory: the
+// greatest depth of any entry, counted as in ListWithDepth, the total number
+// of files and directories, and the number of entries in the widest single
+// directory, the root included.
+func (a *Archive) Stats2() (maxDepth, totalEntries, maxDirWidth int, err error) {
+	widths := make(map[string]int)
+	err = a.walk(func(name string, depth int, _ Entry) error {
+		totalEntries++
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		parent := path.Dir(name)
+		widths[parent]++
+		if widths[parent] > maxDirWidth {
+			maxDirWidth = widths[parent]
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return maxDepth, totalEntries, maxDirWidth, nil
+}
+
+// walk calls fn for every entry in the archive, recursing into each
+// subdirectory after fn has been called for it. Entries in the root directory
+// have a depth of 0. Duplicate names are handled by Options.Duplicates.
+func (a *Archive) walk(fn func(name string, depth int, e Entry) error) error {
+	return a.walkDir("", 0, int(a.header.Start), fn, seenDirs{})
+}
+
+// walkDir walks the directory at offset, whose entries are at depth.
+func (a *Archive) walkDir(parent string, depth, offset int, fn func(name string, depth int, e Entry) error, seen seenDirs) error {
+	if err := a.loadDirectory(); err != nil {
+		return err
+	}
+	entries, names, err := sliceDirectory(a.dir, offset)
+	if err != nil {
+		return err
+	}
+	if err := seen.enter(offset, entries); err != nil {
+		return err
+	}
+	entries, names, err = dedupe(parent, entries, names, a.Options.Duplicates)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		name := path.Join(parent, names[i])
+		if err := fn(name, depth, entry); err != nil {
+			return err
+		}
+		if entry.Flag == 1 {
+			if err := a.walkDir(name, depth+1, int(entry.DirDataOffset), fn, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DepthEntry is an entry listed by ListWithDepth.
+type DepthEntry struct {
+	Path  string
+	Depth int // The number of directories above the entry.
+	IsDir bool
+}
+
+// ListWithDepth lists every file and directory in the archive in directory
+// order along with how deeply it is nested.
+func (a *Archive) ListWithDepth() ([]DepthEntry, error) {
+	var list []DepthEntry
+	err := a.walk(func(name string, depth int, e Entry) error {
+		list = append(list, DepthEntry{Path: name, Depth: depth, IsDir: e.Flag == 1})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// sliceDirectory is readDirectory for a directory that is already decrypted
+// in memory. Entries and names are sliced straight out of dir.
+func sliceDirectory(dir []byte, offset int) ([]Entry, []string, error) {
+	const entrySize = 9
+	if offset < 0 || offset+8 > len(dir) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	numEntries := int64(binary.LittleEndian.Uint32(dir[offset:]))
+	entryOffset := int64(binary.LittleEndian.Uint32(dir[offset+4:]))
+	if err := checkEntryTable(numEntries, entryOffset, int64(len(dir))); err != nil {
+		return nil, nil, err
+	}
+	entries := make([]Entry, numEntries)
+	names := make([]string, numEntries)
+	for i := range entries {
+		raw := dir[int(entryOffset)+i*entrySize:]
+		entries[i] = Entry{
+			NameOffset:    binary.LittleEndian.Uint32(raw),
+			DirDataOffset: binary.LittleEndian.Uint32(raw[4:]),
+			Flag:          raw[8],
+		}
+	}
+	if err := checkEntries(entries, int64(len(dir))); err != nil {
+		return nil, nil, err
+	}
+	for i := range entries {
+		name, err := readName(dir, int(entries[i].NameOffset))
+		if err != nil {
+			return nil, nil, err
+		}
+		names[i] = name
+	}
+	return entries, names, nil
+}
+
+// readName returns the NUL-terminated name at offset in the decrypted
+// directory. Slicing the buffer avoids the trap of reading names through a
+// bufio.Reader wrapped around a seeker: bufio reads ahead, so after
+// ReadBytes(0) the seeker sits past the buffered data rather than just after
+// the name, and the next offset has to be sought again.
+func readName(dir []byte, offset int) (string, error) {
+	if offset < 0 || offset >= len(dir) {
+		return "", io.ErrUnexpectedEOF
+	}
+	end := bytes.IndexByte(dir[offset:], 0)
+	if end < 0 {
+		return "", fmt.Errorf("%w: name at offset %d has no terminator", ErrCorruptDirectory, offset)
+	}
+	return string(dir[offset : offset+end]), nil
+}
@@ -0,0 +1,663 @@
+package hpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.header.Marker != HPIMagic {
+		t.Errorf("Got %x, wanted %x", a.header.Marker, HPIMagic)
+	}
+	if len(a.dir) != int(a.header.DirectorySize) {
+		t.Errorf("Got %d, wanted %d", len(a.dir), a.header.DirectorySize)
+	}
+}
+func TestReadEntry(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numEntries, entryOffset uint32
+	root := bytes.NewReader(a.dir[a.header.Start:])
+	binary.Read(root, binary.LittleEndian, &numEntries)
+	binary.Read(root, binary.LittleEndian, &entryOffset)
+	var entry Entry
+	if err := binary.Read(bytes.NewReader(a.dir[entryOffset:]), binary.LittleEndian, &entry); err != nil {
+		t.Fatal(err)
+	}
+	data, err := a.ReadEntry(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Copyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Errorf("Got %q, wanted %q", data, want)
+	}
+	entry.Flag = 1
+	if _, err := a.ReadEntry(entry); err == nil {
+		t.Error("expected an error reading a directory entry")
+	}
+}
+func TestSizeReport(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk, logical, err := a.SizeReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk != 126032 {
+		t.Errorf("Got %d, wanted %d", onDisk, 126032)
+	}
+	if want := int64(36 + 263256 + 2267); logical != want {
+		t.Errorf("Got %d, wanted %d", logical, want)
+	}
+}
+func TestSizeReportConcurrent(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	// Without ReadAt of its own, the archive is read through seeks, and
+	// yielding between each seek and read lets SizeReport run there.
+	a, err := Open(yieldingReader{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.find("maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if onDisk, _, err := a.SizeReport(); err != nil || onDisk != 126032 {
+				t.Errorf("Got %d, %v, wanted %d", onDisk, err, 126032)
+			}
+			runtime.Gosched()
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if _, err := a.ReadFileAt(f.fd); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// yieldingReader lets other goroutines run before each Read, and hides
+// any ReadAt of the reader it wraps.
+type yieldingReader struct {
+	io.ReadSeeker
+}
+
+func (r yieldingReader) Read(p []byte) (int, error) {
+	runtime.Gosched()
+	return r.ReadSeeker.Read(p)
+}
+func TestFirstChunk(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := a.ReadEntry(Entry{DirDataOffset: 121})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := a.FirstChunk("maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != MaxChunkSize {
+		t.Errorf("Got %d, wanted %d", len(first), MaxChunkSize)
+	}
+	if !bytes.Equal(first, all[:MaxChunkSize]) {
+		t.Error("first chunk does not match the start of the file")
+	}
+	small, err := a.FirstChunk("Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(small) != 36 {
+		t.Errorf("Got %d, wanted %d", len(small), 36)
+	}
+	if _, err := a.FirstChunk("maps/missing.tnt"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+func TestFindArchiveOffset(t *testing.T) {
+	archive, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A stub with a stray marker that is not followed by a usable header.
+	stub := append(bytes.Repeat([]byte("MZ"), 40000), []byte("HAPI\xff\xff\xff\xff")...)
+	buf := append(stub, archive...)
+	r := bytes.NewReader(buf)
+	off, err := FindArchiveOffset(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != int64(len(stub)) {
+		t.Errorf("Got %d, wanted %d", off, len(stub))
+	}
+	a, err := Open(io.NewSectionReader(r, off, r.Size()-off))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Validate(); err != nil {
+		t.Error(err)
+	}
+	if _, err := FindArchiveOffset(bytes.NewReader(stub), int64(len(stub))); err == nil {
+		t.Error("expected an error when there is no archive")
+	}
+}
+func TestOpenAt(t *testing.T) {
+	archive, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Open(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk := bytes.Repeat([]byte{0xcc}, 1234)
+	r := bytes.NewReader(append(append(junk, archive...), junk...))
+	a, err := OpenAt(r, int64(len(junk)), r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range want.List() {
+		got, err := a.Extract(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := want.Extract(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: contents differ", name)
+		}
+	}
+	if _, err := OpenAt(r, 0, r.Size()); err == nil {
+		t.Error("expected an error at the wrong offset")
+	}
+	if _, err := OpenAt(r, r.Size()+1, r.Size()); err == nil {
+		t.Error("expected an error for an offset past the end")
+	}
+}
+func TestArchiveHeader(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Header{Marker: HPIMagic, Save: Version1, DirectorySize: 220, Key: 0xaf, Start: 20}
+	if got := a.Header(); got != want {
+		t.Errorf("Got %+v, wanted %+v", got, want)
+	}
+	if a.Key() != 190 {
+		t.Errorf("Got %d, wanted %d", a.Key(), 190)
+	}
+}
+func TestListWithDepth(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := a.ListWithDepth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DepthEntry{
+		{"Copyright.txt", 0, false},
+		{"maps", 0, true},
+		{"maps/example.tnt", 1, false},
+		{"maps/example.ota", 1, false},
+		{"camps", 0, true},
+		{"camps/useonly", 1, true},
+		{"camps/useonly/example.tdf", 2, false},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("Got %v, wanted %v", list, want)
+	}
+	for i := range want {
+		if list[i] != want[i] {
+			t.Errorf("Got %v, wanted %v", list[i], want[i])
+		}
+	}
+}
+func TestExtensions(t *testing.T) {
+	file, err := os.Open("TADEMO.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err := a.Extensions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{".gaf": 1, ".tdf": 1, ".3do": 2, ".bos": 1, ".cob": 1, ".pcx": 1, ".fbi": 1}
+	if len(counts) != len(want) {
+		t.Errorf("Got %v, wanted %v", counts, want)
+	}
+	for ext, n := range want {
+		if counts[ext] != n {
+			t.Errorf("%s: Got %d, wanted %d", ext, counts[ext], n)
+		}
+	}
+}
+func TestEstimateWork(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, chunks, err := a.EstimateWork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(63 + 32745 + 39433 + 36694 + 15711 + 164 + 938); n != want {
+		t.Errorf("Got %d, wanted %d", n, want)
+	}
+	if chunks != 7 {
+		t.Errorf("Got %d, wanted %d", chunks, 7)
+	}
+}
+func TestRecover(t *testing.T) {
+	buf, err := os.ReadFile("TADEMO.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := Open(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.find("unitsE/zzz.fbi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := a.ReadFileAt(f.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Claim the zlib chunk is LZ77. TADEMO.ufo is not encrypted.
+	buf[f.fd.DataOffset+4+5] = 1
+	if got, err := a.ReadFileAt(f.fd); err == nil && bytes.Equal(got, want) {
+		t.Fatal("expected the damaged chunk to fail without recovery")
+	}
+	a.Options.Recover = true
+	got, err := a.ReadFileAt(f.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("recovered contents differ from the original")
+	}
+}
+func TestReadName(t *testing.T) {
+	dir := []byte("\x00\x00maps\x00example.tnt\x00unterminated")
+	tests := []struct {
+		offset int
+		want   string
+		ok     bool
+	}{
+		{2, "maps", true},
+		{7, "example.tnt", true},
+		{9, "ample.tnt", true},
+		{0, "", true},
+		{19, "", false},
+		{len(dir), "", false},
+		{-1, "", false},
+	}
+	for _, test := range tests {
+		got, err := readName(dir, test.offset)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("readName(%d): Got %q, %v, wanted %q", test.offset, got, err, test.want)
+		}
+	}
+}
+func TestChunkEncryptionStats(t *testing.T) {
+	tests := []struct {
+		fixture string
+		key     byte
+		chunks  int
+	}{
+		{"Example.ufo", 190, 7},
+		{"TADEMO.ufo", 0, 8},
+	}
+	for _, test := range tests {
+		file, err := os.Open(test.fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		a, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.key != test.key {
+			t.Errorf("%s: Got key %d, wanted %d", test.fixture, a.key, test.key)
+		}
+		encrypted, plain, err := a.ChunkEncryptionStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted != test.chunks || plain != 0 {
+			t.Errorf("%s: Got %d encrypted and %d plain, wanted %d and 0", test.fixture, encrypted, plain, test.chunks)
+		}
+	}
+}
+func TestReadAllParallel(t *testing.T) {
+	file, err := os.Open("TADEMO.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := a.ReadAllParallel(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 8 {
+		t.Errorf("Got %d files, wanted %d", len(all), 8)
+	}
+	files, err := a.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		want, err := a.ReadFileAt(f.fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(all[f.name], want) {
+			t.Errorf("%s: contents differ", f.name)
+		}
+	}
+}
+func TestStats2(t *testing.T) {
+	tests := []struct {
+		fixture                string
+		depth, entries, widest int
+	}{
+		{"Example.ufo", 2, 7, 3},
+		{"TADEMO.ufo", 2, 18, 9},
+	}
+	for _, test := range tests {
+		file, err := os.Open(test.fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		a, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		depth, entries, widest, err := a.Stats2()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth != test.depth || entries != test.entries || widest != test.widest {
+			t.Errorf("%s: Got %d, %d, %d, wanted %d, %d, %d", test.fixture, depth, entries, widest, test.depth, test.entries, test.widest)
+		}
+	}
+}
+func TestOpenLazy(t *testing.T) {
+	buf, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := OpenLazy(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := a.FirstChunk("Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Copyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Errorf("Got %q, wanted %q", data, want)
+	}
+	f, err := a.find("camps/useonly/example.tdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.fd.FileSize != 0 {
+		t.Errorf("Got %d, wanted %d", f.fd.FileSize, 0)
+	}
+	for _, name := range []string{"maps", "maps/missing.tnt", "Copyright.txt/x"} {
+		if _, err := a.find(name); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if a.dir != nil {
+		t.Error("lookups loaded the whole directory")
+	}
+	list, err := a.ListWithDepth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 7 {
+		t.Errorf("Got %d entries, wanted %d", len(list), 7)
+	}
+	if len(a.dir) != int(a.header.DirectorySize) {
+		t.Errorf("Got %d, wanted %d", len(a.dir), a.header.DirectorySize)
+	}
+}
+func TestListExtract(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := a.List()
+	want := []string{"Copyright.txt", "maps/example.tnt", "maps/example.ota", "camps/useonly/example.tdf"}
+	if len(list) != len(want) {
+		t.Fatalf("Got %v, wanted %v", list, want)
+	}
+	for i := range want {
+		if list[i] != want[i] {
+			t.Errorf("Got %s, wanted %s", list[i], want[i])
+		}
+	}
+	data, err := a.Extract("Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Copyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Errorf("Got %q, wanted %q", data, want)
+	}
+	if data, err := a.Extract("maps/example.ota"); err != nil || len(data) != 2267 {
+		t.Errorf("Got %d bytes, %v, wanted %d", len(data), err, 2267)
+	}
+	if _, err := a.Extract("maps"); err == nil {
+		t.Error("expected an error extracting a directory")
+	}
+}
+func TestExactPaths(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		file, err := os.Open("Example.ufo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		open := Open
+		if lazy {
+			open = OpenLazy
+		}
+		a, err := open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := a.find(`MAPS\Example.OTA`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.name != "maps/example.ota" || f.fd.FileSize != 2267 {
+			t.Errorf("Got %s with size %d, wanted maps/example.ota with size %d", f.name, f.fd.FileSize, 2267)
+		}
+		a.Options.ExactPaths = true
+		if _, err := a.find(`MAPS\Example.OTA`); err == nil {
+			t.Error("expected an error matching exactly")
+		}
+		if _, err := a.find("maps/example.ota"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+func TestOpenRejectsNonArchives(t *testing.T) {
+	archive, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 100)...)
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"png", png, "bad magic 0x474e5089"},
+		{"short", []byte("HAPI"), "reading header"},
+		{"truncated", archive[:100], "past the end"},
+	}
+	for _, test := range tests {
+		_, err := Open(bytes.NewReader(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: Got %v, wanted an error containing %q", test.name, err, test.want)
+		}
+	}
+	bad := Header{Marker: HPIMagic, Save: Version1, Start: 4, DirectorySize: 100}
+	if err := ValidateHeader(bad); err == nil {
+		t.Error("expected an error for a start inside the header")
+	}
+}
+func TestOpenSavedGame(t *testing.T) {
+	// The header of a saved game, followed by what would be its data.
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, Header{
+		Marker:        HPIMagic,
+		Save:          SavedGame,
+		DirectorySize: 64,
+		Start:         20,
+	})
+	buf.Write(make([]byte, 64))
+	if _, err := Open(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrUnsupportedSavedGame) {
+		t.Errorf("Got %v, wanted %v", err, ErrUnsupportedSavedGame)
+	}
+	r := bytes.NewReader(buf.Bytes())
+	if _, err := FindArchiveOffset(r, r.Size()); err == nil {
+		t.Error("expected no archive to be found in a saved game")
+	}
+}
+func TestFileInfos(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := a.FileInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]FileInfo{
+		"maps/example.tnt":          {Path: "maps/example.tnt", Size: 263256, Compression: 1, CompressedSize: 32745 + 39433 + 36694 + 15711 + 164 - 5*19, Chunks: 5},
+		"camps/useonly/example.tdf": {Path: "camps/useonly/example.tdf", Compression: 1},
+	}
+	if len(infos) != 4 {
+		t.Fatalf("Got %d files, wanted %d", len(infos), 4)
+	}
+	for _, info := range infos {
+		if w, ok := want[info.Path]; ok && info != w {
+			t.Errorf("Got %+v, wanted %+v", info, w)
+		}
+	}
+}
+func TestOpenVersion2(t *testing.T) {
+	// A TA: Kingdoms header: the version, then the directory's offset and
+	// size, the names' offset and size, the data's offset and a trailer.
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint32{HPIMagic, Version2, 32, 64, 96, 16, 112, 0})
+	buf.Write(make([]byte, 96))
+	_, err := Open(bytes.NewReader(buf.Bytes()))
+	if !errors.Is(err, ErrUnsupportedVersion) || !strings.Contains(err.Error(), "0x00020000") {
+		t.Errorf("Got %v, wanted %v", err, ErrUnsupportedVersion)
+	}
+	if got, err := DetectFormat(bytes.NewReader(buf.Bytes())); err != nil || got != FormatHPI {
+		t.Errorf("Got %v, %v, wanted %v", got, err, FormatHPI)
+	}
+}
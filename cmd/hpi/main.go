@@ -0,0 +1,128 @@
+// Command hpi lists and extracts Total Annihilation HPI archives.
+//
+// Usage:
+//
+//	hpi [-v] list archive.hpi
+//	hpi [-v] extract archive.hpi [dest]
+//	hpi [-v] cat archive.hpi path/to/file
+//
+// list prints the directory tree, extract writes every file below dest, the
+// current directory by default, and cat writes one file to standard output.
+// With -v, extract prints each file as it is written.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cosmouser/hpi"
+)
+
+// errUsage is returned for bad arguments, after the usage is printed.
+var errUsage = errors.New("usage")
+
+var verbose = flag.Bool("v", false, "print each file as it is extracted")
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if err := run(flag.Args()); err != nil {
+		if err == errUsage {
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "hpi:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: hpi [-v] list archive.hpi
+       hpi [-v] extract archive.hpi [dest]
+       hpi [-v] cat archive.hpi path/to/file`)
+	flag.PrintDefaults()
+}
+
+// run runs the subcommand named by args[0].
+func run(args []string) error {
+	if len(args) < 2 {
+		usage()
+		return errUsage
+	}
+	switch cmd, rest := args[0], args[2:]; {
+	case cmd == "list" && len(rest) == 0:
+		return withArchive(args[1], list)
+	case cmd == "extract" && len(rest) <= 1:
+		dest := "."
+		if len(rest) == 1 {
+			dest = rest[0]
+		}
+		return withArchive(args[1], func(a *hpi.Archive) error {
+			return extract(a, dest)
+		})
+	case cmd == "cat" && len(rest) == 1:
+		return withArchive(args[1], func(a *hpi.Archive) error {
+			return cat(a, rest[0])
+		})
+	}
+	usage()
+	return errUsage
+}
+
+// withArchive opens the archive called name and calls fn with it.
+func withArchive(name string, fn func(a *hpi.Archive) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	a, err := hpi.Open(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return fn(a)
+}
+
+// list prints the directory tree of a, indenting each entry by its depth.
+func list(a *hpi.Archive) error {
+	entries, err := a.ListWithDepth()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Path[strings.LastIndex(e.Path, "/")+1:]
+		if e.IsDir {
+			name += "/"
+		}
+		fmt.Printf("%s%s\n", strings.Repeat("  ", e.Depth), name)
+	}
+	return nil
+}
+
+// extract writes every file in a below dest.
+func extract(a *hpi.Archive, dest string) error {
+	if *verbose {
+		a.Options.Progress = func(name string, written, total int64) {
+			if written == 0 {
+				fmt.Fprintf(os.Stderr, "%s (%d bytes)\n", name, total)
+			}
+		}
+	}
+	_, err := a.ExtractMapped(dest)
+	return err
+}
+
+// cat writes the file called name in a to standard output.
+func cat(a *hpi.Archive, name string) error {
+	data, err := a.Extract(name)
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "%s (%d bytes)\n", name, len(data))
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
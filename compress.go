@@ -0,0 +1,43 @@
+package hpi
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Decompressor decodes the data of a chunk, after any chunk-level
+// decryption, into at most decompressedSize bytes.
+type Decompressor func(data []byte, decompressedSize int) ([]byte, error)
+
+var (
+	decompressorsMu sync.RWMutex
+	decompressors   = make(map[byte]Decompressor)
+)
+
+// RegisterDecompressor makes a custom compression method readable. Methods
+// 0 (stored), 1 (LZ77) and 2 (zlib) are built in and cannot be replaced;
+// any other method, such as the 3 used by some community tools, can be
+// registered from an init function:
+//
+//	func init() {
+//		hpi.RegisterDecompressor(3, func(data []byte, size int) ([]byte, error) {
+//			return mycodec.Decode(data, size)
+//		})
+//	}
+//
+// Registering a method again replaces its decompressor.
+func RegisterDecompressor(method byte, d Decompressor) {
+	if method <= 2 {
+		panic(fmt.Sprintf("hpi: compression method %d is built in", method))
+	}
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	decompressors[method] = d
+}
+
+// decompressor returns the registered decompressor for method, or nil.
+func decompressor(method byte) Decompressor {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	return decompressors[method]
+}
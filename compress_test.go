@@ -0,0 +1,59 @@
+package hpi
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// methodFile stores data as a single chunk that claims to use method.
+func methodFile(data []byte, method byte) []byte {
+	raw := storedFile(data, MaxChunkSize)
+	// The method follows the table, the marker and a padding byte.
+	raw[4+5] = method
+	return raw
+}
+func TestRegisterDecompressor(t *testing.T) {
+	data := []byte("reversed by a custom codec")
+	archive := methodFile(data, 3)
+	d := decoder{archive: bytes.NewReader(archive), chunkSize: MaxChunkSize}
+	fd := FileData{FileSize: uint32(len(data))}
+	var out bytes.Buffer
+	RegisterDecompressor(3, func(data []byte, size int) ([]byte, error) {
+		if len(data) != size {
+			return nil, fmt.Errorf("got %d bytes, wanted %d", len(data), size)
+		}
+		rev := make([]byte, len(data))
+		for i, b := range data {
+			rev[len(data)-1-i] = b
+		}
+		return rev, nil
+	})
+	if err := d.decodeFile(fd, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "cedoc motsuc a yb desrever"; out.String() != want {
+		t.Errorf("Got %q, wanted %q", out.String(), want)
+	}
+}
+func TestUnknownCompressionMethod(t *testing.T) {
+	data := []byte("nobody knows this method")
+	archive := methodFile(data, 0x7f)
+	d := decoder{archive: bytes.NewReader(archive), chunkSize: MaxChunkSize}
+	err := d.decodeFile(FileData{FileSize: uint32(len(data))}, &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("expected an error for an unknown method")
+	}
+	if !strings.Contains(err.Error(), "chunk 0") {
+		t.Errorf("error %q does not name the chunk", err)
+	}
+}
+func TestRegisterBuiltinPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering method 1 to panic")
+		}
+	}()
+	RegisterDecompressor(1, nil)
+}
@@ -0,0 +1,78 @@
+package hpi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+)
+
+// ToZip writes every file in the HPI archive in src to a zip file written
+// to dst, with the paths and decompressed contents of the HPI. Directories
+// get entries of their own, so empty ones are kept. Files are written as
+// they are decoded, without being held in memory.
+func ToZip(src io.ReadSeeker, dst io.Writer) error {
+	zw := zip.NewWriter(dst)
+	err := convert(src, func(name string, fd *FileData) (io.Writer, error) {
+		if fd == nil {
+			return zw.Create(name + "/")
+		}
+		return zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ToTar is ToZip that writes a tar file instead.
+func ToTar(src io.ReadSeeker, dst io.Writer) error {
+	tw := tar.NewWriter(dst)
+	err := convert(src, func(name string, fd *FileData) (io.Writer, error) {
+		header := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}
+		if fd == nil {
+			header.Name += "/"
+			header.Mode = 0755
+			header.Typeflag = tar.TypeDir
+		} else {
+			header.Size = int64(fd.FileSize)
+		}
+		return tw, tw.WriteHeader(header)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// convert opens the HPI archive in src and calls create for each entry in
+// directory order, with a nil fd for directories. The file's contents are
+// written to the returned io.Writer.
+func convert(src io.ReadSeeker, create func(name string, fd *FileData) (io.Writer, error)) error {
+	a, err := Open(src)
+	if err != nil {
+		return err
+	}
+	d := a.decoder()
+	return a.walk(func(name string, _ int, e Entry) error {
+		if unsafePath(name) {
+			return fmt.Errorf("%s: unsafe path", name)
+		}
+		if e.Flag == 1 {
+			_, err := create(name, nil)
+			return err
+		}
+		fd, err := a.fileData(int(e.DirDataOffset))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		w, err := create(name, &fd)
+		if err != nil {
+			return err
+		}
+		if err := d.decodeFile(fd, w); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	})
+}
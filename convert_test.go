@@ -0,0 +1,103 @@
+package hpi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestToZip(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := a.ReadAllParallel(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ToZip(file, &buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]byte)
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got[f.Name], err = io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	compare(t, got, want)
+	if len(zr.File) != 7 {
+		t.Errorf("Got %d entries, wanted %d", len(zr.File), 7)
+	}
+}
+func TestToTar(t *testing.T) {
+	file, err := os.Open("TADEMO.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := a.ReadAllParallel(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ToTar(file, &buf); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	got := make(map[string][]byte)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeDir {
+			continue
+		}
+		if got[h.Name], err = io.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compare(t, got, want)
+}
+
+// compare reports the differences between two sets of file contents.
+func compare(t *testing.T, got, want map[string][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("Got %d files, wanted %d", len(got), len(want))
+	}
+	for name, data := range want {
+		if !bytes.Equal(got[name], data) {
+			t.Errorf("%s: contents differ", name)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package hpi
+
+import (
+	"errors"
+	"io"
+)
+
+// NewDirectoryReader returns a reader for the directory of the archive
+// whose header is header, for use with TraverseTree, Walk and the other
+// free functions in place of the one from LoadDirectory. Instead of
+// decrypting the whole directory up front, it reads and decrypts only the
+// bytes that are read from it, which keeps startup cheap for archives with
+// very large directories when only part of the tree is needed. As with
+// LoadDirectory, offsets into it are the offsets stored in the file, and
+// the header reads as zeros. Each read goes to archive, so reading the
+// whole directory this way is slower than with LoadDirectory.
+func NewDirectoryReader(archive io.ReaderAt, header Header) io.ReadSeeker {
+	return &dirReader{
+		archive: archive,
+		key:     header.GetKey(),
+		start:   int64(header.Start),
+		size:    int64(header.DirectorySize),
+	}
+}
+
+// dirReader is the reader returned by NewDirectoryReader.
+type dirReader struct {
+	archive io.ReaderAt
+	key     byte
+	start   int64 // Where the directory starts; earlier bytes read as zeros.
+	size    int64 // Where the directory ends.
+	pos     int64
+}
+
+func (r *dirReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *dirReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var err error
+	if rest := r.size - off; int64(len(p)) > rest {
+		p, err = p[:rest], io.EOF
+	}
+	n := 0
+	for ; n < len(p) && off+int64(n) < r.start; n++ {
+		p[n] = 0
+	}
+	if n < len(p) {
+		buf, rerr := ReadAndDecryptAt(r.archive, r.key, len(p)-n, int(off)+n)
+		if rerr != nil {
+			return n, rerr
+		}
+		n += copy(p[n:], buf)
+	}
+	return n, err
+}
+
+func (r *dirReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,55 @@
+package hpi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDirectoryReader(t *testing.T) {
+	for _, fixture := range []string{"Example.ufo", "TADEMO.ufo"} {
+		file, err := os.Open(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		header, key, eager, err := LoadDirectory(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]byte, eager.Len())
+		eager.ReadAt(want, 0)
+		lazy := NewDirectoryReader(file, header)
+		if err := iotest.TestReader(lazy, want); err != nil {
+			t.Errorf("%s: %v", fixture, err)
+		}
+		walk := func(dir io.ReadSeeker) string {
+			var s bytes.Buffer
+			if err := Walk(file, dir, key, func(path string, fd FileData) error {
+				fmt.Fprintln(&s, path, fd)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			return s.String()
+		}
+		if got, all := walk(lazy), walk(eager); got != all {
+			t.Errorf("%s: Got %s, wanted %s", fixture, got, all)
+		}
+		dest := t.TempDir()
+		if err := TraverseTree(file, lazy, key, dest, int(header.Start)); err != nil {
+			t.Fatalf("%s: %v", fixture, err)
+		}
+		if _, ok, err := FindEntry(lazy, key, int(header.Start), "no/such/file"); ok || err != nil {
+			t.Errorf("%s: Got %v, %v, wanted no file", fixture, ok, err)
+		}
+		matches, _ := filepath.Glob(filepath.Join(dest, "*"))
+		if len(matches) == 0 {
+			t.Errorf("%s: nothing was extracted", fixture)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package hpi
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DuplicatePolicy decides what happens when a directory holds more than one
+// entry with the same name. Names are compared case-insensitively, as the
+// game does. Such archives are corrupt or deliberately crafted, since
+// extracting them would silently overwrite one entry with another.
+type DuplicatePolicy int
+
+const (
+	// DuplicatesError fails with an error naming the duplicate path.
+	DuplicatesError DuplicatePolicy = iota
+
+	// DuplicatesKeepFirst uses the first entry with a name and ignores
+	// the rest.
+	DuplicatesKeepFirst
+
+	// DuplicatesKeepLast uses the last entry with a name and ignores the
+	// ones before it, which is what extracting every entry in order
+	// leaves on disk.
+	DuplicatesKeepLast
+)
+
+// dedupe applies policy to the entries of the directory parent, returning
+// them in their original order with the ignored duplicates removed.
+func dedupe(parent string, entries []Entry, names []string, policy DuplicatePolicy) ([]Entry, []string, error) {
+	last := make(map[string]int, len(names))
+	for i, name := range names {
+		key := strings.ToLower(name)
+		if _, ok := last[key]; ok && policy == DuplicatesError {
+			return nil, nil, fmt.Errorf("%s: duplicate entry", path.Join(parent, name))
+		}
+		if _, ok := last[key]; !ok || policy == DuplicatesKeepLast {
+			last[key] = i
+		}
+	}
+	if len(last) == len(names) {
+		return entries, names, nil
+	}
+	var (
+		keptEntries = make([]Entry, 0, len(last))
+		keptNames   = make([]string, 0, len(last))
+	)
+	for i, name := range names {
+		if last[strings.ToLower(name)] == i {
+			keptEntries = append(keptEntries, entries[i])
+			keptNames = append(keptNames, name)
+		}
+	}
+	return keptEntries, keptNames, nil
+}
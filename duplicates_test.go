@@ -0,0 +1,115 @@
+package hpi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// duplicateArchive returns an unencrypted archive whose maps directory
+// lists example.ota, of 2267 bytes, and then EXAMPLE.OTA, of 263256.
+func duplicateArchive(t *testing.T) []byte {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	src, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.CreateTemp(t.TempDir(), "dup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := NewWriter(f, 0)
+	for _, name := range []string{"maps/example.ota", "maps/example.tnt"} {
+		if err := CopyFile(w, src, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directory is not encrypted, so the second name can be patched.
+	return bytes.Replace(buf, []byte("example.tnt\x00"), []byte("EXAMPLE.OTA\x00"), 1)
+}
+func TestDuplicates(t *testing.T) {
+	buf := duplicateArchive(t)
+	tests := []struct {
+		policy DuplicatePolicy
+		size   uint32
+	}{
+		{DuplicatesKeepFirst, 2267},
+		{DuplicatesKeepLast, 263256},
+	}
+	for _, test := range tests {
+		a, err := Open(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.files(); err == nil {
+			t.Error("expected an error for a duplicate entry")
+		}
+		a.Options.Duplicates = test.policy
+		files, err := a.files()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("Got %d files, wanted 1", len(files))
+		}
+		if files[0].fd.FileSize != test.size {
+			t.Errorf("Got %d, wanted %d", files[0].fd.FileSize, test.size)
+		}
+	}
+}
+func TestTraverseTreeDuplicates(t *testing.T) {
+	buf := duplicateArchive(t)
+	header, key, dir, err := LoadDirectory(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		policy DuplicatePolicy
+		size   int64
+	}{
+		{DuplicatesKeepFirst, 2267},
+		{DuplicatesKeepLast, 263256},
+	}
+	for _, test := range tests {
+		dest := t.TempDir()
+		opts := ExtractOptions{Duplicates: test.policy}
+		if err := TraverseTreeOptions(context.Background(), bytes.NewReader(buf), dir, key, dest, int(header.Start), opts); err != nil {
+			t.Fatal(err)
+		}
+		matches, err := filepath.Glob(filepath.Join(dest, "maps", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 1 {
+			t.Fatalf("Got %v, wanted one file", matches)
+		}
+		info, err := os.Stat(matches[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != test.size {
+			t.Errorf("Got %d, wanted %d", info.Size(), test.size)
+		}
+	}
+	if err := TraverseTree(bytes.NewReader(buf), dir, key, t.TempDir(), int(header.Start)); err == nil {
+		t.Error("expected an error for a duplicate entry")
+	}
+}
@@ -0,0 +1,408 @@
+package hpi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExtractOptions controls how an Archive extracts files to disk.
+type ExtractOptions struct {
+	// SkipMissing makes ExtractList ignore requested paths that are not in
+	// the archive instead of failing before anything is written.
+	SkipMissing bool
+
+	// VerifyChecksums checks each chunk's stored data against the
+	// Checksum in its header while extracting, and fails on a mismatch
+	// with an error naming the file and chunk. Validate always checks.
+	// Recover turns these checks off.
+	VerifyChecksums bool
+
+	// Progress, if not nil, is called as each file is extracted: once
+	// before anything is written and again after each chunk, with the
+	// bytes written so far and the file's decompressed size. name is the
+	// archive path of the file.
+	Progress func(name string, written, total int64)
+
+	// Rename maps an archive path to the slash-separated path, relative to
+	// the destination, that the file is written to. A nil Rename keeps the
+	// archive's layout.
+	Rename func(name string) string
+
+	// Timings, if not nil, has the time spent in each stage of extraction
+	// added to it.
+	Timings *Timings
+
+	// Recover salvages chunks whose header names the wrong compression
+	// method. When a chunk fails to decode to its DecompressedSize, the
+	// other methods are tried in turn. Checksums are not checked at all,
+	// even with VerifyChecksums set, since a chunk worth salvaging often
+	// fails them. It is a heuristic and slower, so it is off by default.
+	Recover bool
+
+	// Quarantine extracts files whose paths contain "..", are absolute or
+	// have a component longer than 255 bytes into QuarantineDir below the
+	// destination instead, under sanitized names. The archive path of each
+	// quarantined file is recorded in QuarantineDir/manifest.json. Without
+	// it, extraction fails at the first path that would escape the
+	// destination.
+	Quarantine bool
+
+	// ExactPaths makes lookups by name, such as Extract and FirstChunk,
+	// match archive paths exactly. By default both sides are compared
+	// after NormalizePath, as TA does.
+	ExactPaths bool
+
+	// Duplicates decides which entry is used when a directory lists the
+	// same name more than once. By default such archives are rejected.
+	Duplicates DuplicatePolicy
+
+	// ModTime, if not zero, is set as the access and modification time of
+	// every extracted file, so that extracting the same archive twice
+	// gives identical trees. HPI archives do not record times themselves.
+	ModTime time.Time
+
+	// DirMode is the permissions directories are created with, before the
+	// umask. Zero means 0744.
+	DirMode os.FileMode
+
+	// FileMode is the permissions files are created with, before the
+	// umask. Zero means 0666, as with os.Create.
+	FileMode os.FileMode
+
+	// Sink, if not nil, receives the extracted files in place of the OS
+	// filesystem, and ModTime, DirMode and FileMode are ignored. Sidecar
+	// files such as ExtractObjects' manifest.json go to the Sink too, but
+	// the quarantine manifest is still written to disk.
+	Sink Sink
+
+	// ContinueOnError makes TraverseTreeOptions carry on past files and
+	// directories that fail to extract, and return the errors for all of
+	// them together, joined with errors.Join, once the rest of the tree is
+	// written. Cancelling the context still stops extraction at once.
+	ContinueOnError bool
+
+	// Skip, if not nil, is called by TraverseTreeOptions with the
+	// slash-separated archive path of each entry before it is extracted,
+	// and reports whether to leave the entry out. A directory that is left
+	// out is not read at all, so nothing below it is extracted or passed
+	// to Skip.
+	Skip func(path string, isDir bool) bool
+}
+
+// ExtractList extracts exactly the named files into dest and returns how
+// many were written. Paths are relative to the root of the archive and are
+// compared as by Extract, so they match after NormalizePath unless
+// Options.ExactPaths is set.
+func (a *Archive) ExtractList(dest string, paths []string) (int, error) {
+	files, err := a.files()
+	if err != nil {
+		return 0, err
+	}
+	byName := make(map[string]archiveFile, len(files))
+	for _, f := range files {
+		byName[a.pathKey(f.name)] = f
+	}
+	var (
+		selected []archiveFile
+		missing  []string
+		seen     = make(map[string]bool, len(paths))
+	)
+	for _, p := range paths {
+		key := a.pathKey(p)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		f, ok := byName[key]
+		if !ok {
+			missing = append(missing, p)
+			continue
+		}
+		selected = append(selected, f)
+	}
+	if len(missing) > 0 && !a.Options.SkipMissing {
+		return 0, fmt.Errorf("%w: %s", ErrNotFound, strings.Join(missing, ", "))
+	}
+	for i, f := range selected {
+		if err := a.extractFile(dest, f); err != nil {
+			return i, err
+		}
+	}
+	return len(selected), nil
+}
+
+// ExtractMapped extracts every file into dest and returns a map from each
+// output path, as written on disk, to the archive path it came from. Tools
+// that rename files with Options.Rename can use it to find the archive entry
+// for an edited file. It is an error for two files to be renamed to the same
+// output path.
+func (a *Archive) ExtractMapped(dest string) (map[string]string, error) {
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	mapping := make(map[string]string, len(files))
+	for _, f := range files {
+		name, _, err := a.outputPath(dest, f.name)
+		if err != nil {
+			return mapping, err
+		}
+		if prev, ok := mapping[name]; ok {
+			return mapping, fmt.Errorf("%s and %s both extract to %s", prev, f.name, name)
+		}
+		if err := a.extractFile(dest, f); err != nil {
+			return mapping, err
+		}
+		mapping[name] = f.name
+	}
+	return mapping, nil
+}
+
+// outputPath returns where the file at name is extracted to below dest and
+// whether it is quarantined there. It is an error for the file to land
+// outside dest.
+func (a *Archive) outputPath(dest, name string) (string, bool, error) {
+	if a.Options.Rename != nil {
+		name = a.Options.Rename(name)
+	}
+	if a.Options.Quarantine && suspicious(name) {
+		return filepath.Join(dest, QuarantineDir, quarantineName(name)), true, nil
+	}
+	out := filepath.Join(dest, filepath.FromSlash(name))
+	if unsafePath(name) || !within(dest, out) {
+		return "", false, fmt.Errorf("%s: path escapes the destination", name)
+	}
+	return out, false, nil
+}
+
+// extractFile decodes f into its place below dest.
+func (a *Archive) extractFile(dest string, f archiveFile) error {
+	name, quarantined, err := a.outputPath(dest, f.name)
+	if err != nil {
+		return err
+	}
+	if err := a.extractFileTo(context.Background(), name, f); err != nil {
+		return err
+	}
+	if quarantined {
+		return recordQuarantine(dest, filepath.Base(name), f.name)
+	}
+	return nil
+}
+
+// extractFileTo decodes f into the file called name. If decoding fails or
+// ctx is cancelled part way, the partly written file is removed.
+func (a *Archive) extractFileTo(ctx context.Context, name string, f archiveFile) error {
+	sink := a.Options.sink()
+	if err := sink.Mkdir(filepath.Dir(name)); err != nil {
+		return err
+	}
+	out, err := sink.Create(name)
+	if err != nil {
+		return err
+	}
+	d := a.decoder()
+	d.ctx = ctx
+	w := io.Writer(out)
+	if a.Options.Progress != nil {
+		w = &progressWriter{w: out, name: f.name, total: int64(f.fd.FileSize), fn: a.Options.Progress}
+		a.Options.Progress(f.name, 0, int64(f.fd.FileSize))
+	}
+	err = d.decodeFile(f.fd, w)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if r, ok := sink.(interface{ Remove(string) error }); ok {
+			r.Remove(name)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%s: %w", f.name, err)
+	}
+	return nil
+}
+
+// ExtractObjects extracts every file into a content-addressable layout below
+// dest: a file whose SHA-256 is abcdef... is written to objects/ab/cdef...,
+// so identical files share one object even across archives. The returned
+// map from archive path to hash is also written to dest/manifest.json.
+// Everything is written through Options.Sink as by Extract. Each file is
+// decoded once to hash it and again to write its object, unless the object
+// is already written; on the OS filesystem that includes objects left in
+// dest by an earlier extraction.
+func (a *Archive) ExtractObjects(dest string) (map[string]string, error) {
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	sink := a.Options.sink()
+	objects := filepath.Join(dest, "objects")
+	if err := sink.Mkdir(objects); err != nil {
+		return nil, err
+	}
+	manifest := make(map[string]string, len(files))
+	written := make(map[string]bool, len(files))
+	for _, f := range files {
+		sum, err := a.contentHash(f, nil)
+		if err != nil {
+			return nil, err
+		}
+		manifest[f.name] = sum
+		name := filepath.Join(objects, sum[:2], sum[2:])
+		if written[sum] {
+			continue
+		}
+		written[sum] = true
+		if a.Options.Sink == nil {
+			if _, err := os.Stat(name); err == nil {
+				continue
+			}
+		}
+		if err := a.extractFileTo(context.Background(), name, f); err != nil {
+			return nil, err
+		}
+	}
+	buf, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(sink, filepath.Join(dest, "manifest.json"), buf); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ExtractSkeleton recreates the layout of the archive below dest without
+// decoding anything: every directory is created, including empty ones, and
+// every file is created empty. Files are placed according to Options.Rename;
+// directories keep their archive paths.
+func (a *Archive) ExtractSkeleton(dest string) error {
+	return a.walk(func(name string, _ int, e Entry) error {
+		if e.Flag == 1 {
+			if unsafePath(name) {
+				return fmt.Errorf("%s: path escapes the destination", name)
+			}
+			return a.Options.sink().Mkdir(filepath.Join(dest, filepath.FromSlash(name)))
+		}
+		out, quarantined, err := a.outputPath(dest, name)
+		if err != nil {
+			return err
+		}
+		sink := a.Options.sink()
+		if err := sink.Mkdir(filepath.Dir(out)); err != nil {
+			return err
+		}
+		f, err := sink.Create(out)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if quarantined {
+			return recordQuarantine(dest, filepath.Base(out), name)
+		}
+		return nil
+	})
+}
+
+// ExtractSequence extracts every file, in directory order, directly into
+// dest under sequential numbers: 0001.raw, 0002.raw and so on when ext is
+// ".raw". An empty ext keeps each file's own extension. The numbers are
+// padded to four digits, or more for archives with more files. A sidecar
+// dest/sequence.json maps each numbered name back to its archive path.
+// Everything is written through Options.Sink as by Extract.
+func (a *Archive) ExtractSequence(dest, ext string) error {
+	files, err := a.files()
+	if err != nil {
+		return err
+	}
+	sink := a.Options.sink()
+	if err := sink.Mkdir(dest); err != nil {
+		return err
+	}
+	width := len(strconv.Itoa(len(files)))
+	if width < 4 {
+		width = 4
+	}
+	sequence := make(map[string]string, len(files))
+	for i, f := range files {
+		suffix := ext
+		if suffix == "" {
+			suffix = path.Ext(f.name)
+		}
+		name := fmt.Sprintf("%0*d%s", width, i+1, suffix)
+		if err := a.extractFileTo(context.Background(), filepath.Join(dest, name), f); err != nil {
+			return err
+		}
+		sequence[name] = f.name
+	}
+	buf, err := json.MarshalIndent(sequence, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(sink, filepath.Join(dest, "sequence.json"), buf)
+}
+
+// ExtractChunks writes each chunk of the named file to dest as it is stored,
+// without decompressing it, for studying how the file was compressed.
+// Chunk n is written to chunk_nnn.bin with any chunk encryption removed, so
+// that it holds exactly the compressed body, and the chunk headers are
+// written to chunks.json in the same order. Everything is written through
+// Options.Sink as by Extract.
+func (a *Archive) ExtractChunks(name, dest string) error {
+	f, err := a.find(name)
+	if err != nil {
+		return err
+	}
+	chunks, err := a.decoder().chunks(f.fd)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	sink := a.Options.sink()
+	if err := sink.Mkdir(dest); err != nil {
+		return err
+	}
+	headers := make([]ChunkHeader, len(chunks))
+	for i, chunk := range chunks {
+		if chunk.Encrypted != 0 {
+			chunk.Decrypt()
+		}
+		out := filepath.Join(dest, fmt.Sprintf("chunk_%03d.bin", i))
+		if err := writeFile(sink, out, chunk.Data); err != nil {
+			return err
+		}
+		headers[i] = chunk.ChunkHeader
+	}
+	buf, err := json.MarshalIndent(headers, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(sink, filepath.Join(dest, "chunks.json"), buf)
+}
+
+// progressWriter reports the bytes written through it to an
+// ExtractOptions.Progress function.
+type progressWriter struct {
+	w              io.Writer
+	name           string
+	written, total int64
+	fn             func(name string, written, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	p.fn(p.name, p.written, p.total)
+	return n, err
+}
@@ -0,0 +1,353 @@
+package hpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractList(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	// Paths are compared as by Extract, so these name two files.
+	paths := []string{"maps/example.ota", "COPYRIGHT.txt", `MAPS\example.ota`}
+	n, err := a.ExtractList(dest, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Got %d, wanted %d", n, 2)
+	}
+	info, err := os.Stat(filepath.Join(dest, "maps", "example.ota"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2267 {
+		t.Errorf("Got %d, wanted %d", info.Size(), 2267)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "maps", "example.tnt")); !os.IsNotExist(err) {
+		t.Error("extracted a file that was not requested")
+	}
+	a.Options.ExactPaths = true
+	if _, err := a.ExtractList(t.TempDir(), paths); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got %v, wanted %v", err, ErrNotFound)
+	}
+}
+func TestExtractListMissing(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	paths := []string{"Copyright.txt", "units/missing.fbi"}
+	if _, err := a.ExtractList(dest, paths); err == nil {
+		t.Error("expected an error for a missing path")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "Copyright.txt")); !os.IsNotExist(err) {
+		t.Error("extracted files despite a missing path")
+	}
+	a.Options.SkipMissing = true
+	n, err := a.ExtractList(dest, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Got %d, wanted %d", n, 1)
+	}
+}
+func TestExtractObjects(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	manifest, err := a.ExtractObjects(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 4 {
+		t.Errorf("Got %d, wanted %d", len(manifest), 4)
+	}
+	sum := manifest["Copyright.txt"]
+	if want := "1ff5bc57b9d6acee4805837595f06e661175b6f12f20134755c0e7f692ce784b"; sum != want {
+		t.Fatalf("Got %s, wanted %s", sum, want)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "objects", sum[:2], sum[2:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Copyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Errorf("Got %q, wanted %q", data, want)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "manifest.json")); err != nil {
+		t.Error(err)
+	}
+	// Extracting again into the same store reuses the existing objects.
+	again, err := a.ExtractObjects(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again["maps/example.tnt"] != manifest["maps/example.tnt"] {
+		t.Error("hash changed between extractions")
+	}
+}
+func TestExtractMapped(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Options.Rename = func(name string) string {
+		return strings.ToUpper(path.Base(name))
+	}
+	dest := t.TempDir()
+	mapping, err := a.ExtractMapped(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		filepath.Join(dest, "COPYRIGHT.TXT"): "Copyright.txt",
+		filepath.Join(dest, "EXAMPLE.TNT"):   "maps/example.tnt",
+		filepath.Join(dest, "EXAMPLE.OTA"):   "maps/example.ota",
+		filepath.Join(dest, "EXAMPLE.TDF"):   "camps/useonly/example.tdf",
+	}
+	if len(mapping) != len(want) {
+		t.Fatalf("Got %v, wanted %v", mapping, want)
+	}
+	for out, name := range want {
+		if mapping[out] != name {
+			t.Errorf("%s: Got %q, wanted %q", out, mapping[out], name)
+		}
+		if _, err := os.Stat(out); err != nil {
+			t.Error(err)
+		}
+	}
+	a.Options.Rename = func(name string) string { return "same" }
+	if _, err := a.ExtractMapped(t.TempDir()); err == nil {
+		t.Error("expected an error when files collide")
+	}
+}
+func TestExtractSkeleton(t *testing.T) {
+	file, err := os.Open("TADEMO.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := a.ExtractSkeleton(dest); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dest, "bitmaps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Error("empty directory bitmaps was not created")
+	}
+	info, err = os.Stat(filepath.Join(dest, "unitsE", "zzz.fbi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("Got %d, wanted %d", info.Size(), 0)
+	}
+}
+func TestExtractSequence(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := a.ExtractSequence(dest, ".raw"); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(filepath.Join(dest, "sequence.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sequence map[string]string
+	if err := json.Unmarshal(buf, &sequence); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"0001.raw": "Copyright.txt",
+		"0002.raw": "maps/example.tnt",
+		"0003.raw": "maps/example.ota",
+		"0004.raw": "camps/useonly/example.tdf",
+	}
+	for name, archivePath := range want {
+		if sequence[name] != archivePath {
+			t.Errorf("%s: Got %q, wanted %q", name, sequence[name], archivePath)
+		}
+	}
+	info, err := os.Stat(filepath.Join(dest, "0003.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2267 {
+		t.Errorf("Got %d, wanted %d", info.Size(), 2267)
+	}
+	keep := t.TempDir()
+	if err := a.ExtractSequence(keep, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(keep, "0002.tnt")); err != nil {
+		t.Error(err)
+	}
+}
+func TestExtractChunks(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := a.ExtractChunks("maps/example.tnt", dest); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(filepath.Join(dest, "chunks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headers []ChunkHeader
+	if err := json.Unmarshal(buf, &headers); err != nil {
+		t.Fatal(err)
+	}
+	sizes := []int{32745, 39433, 36694, 15711, 164}
+	if len(headers) != len(sizes) {
+		t.Fatalf("Got %d chunks, wanted %d", len(headers), len(sizes))
+	}
+	for i, size := range sizes {
+		body, err := os.ReadFile(filepath.Join(dest, fmt.Sprintf("chunk_%03d.bin", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := size - binary.Size(ChunkHeader{}); len(body) != want {
+			t.Errorf("chunk %d: Got %d bytes, wanted %d", i, len(body), want)
+		}
+		if headers[i].CompressedSize != uint32(len(body)) {
+			t.Errorf("chunk %d: Got %d, wanted %d", i, headers[i].CompressedSize, len(body))
+		}
+	}
+	body, err := os.ReadFile(filepath.Join(dest, "chunk_000.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := a.FirstChunk("maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Decompress(body, int(headers[0].DecompressedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers[0].CompressionMethod != 1 || !bytes.Equal(data, first) {
+		t.Error("first chunk does not decompress to the start of the file")
+	}
+	if err := a.ExtractChunks("maps/missing.tnt", dest); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+func TestVerifyChecksums(t *testing.T) {
+	buf, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Turn the first literal of Copyright.txt's LZ77 chunk from 'C' into
+	// 'K'. It is byte 1 of the chunk data, which starts after the size
+	// table and chunk header, and is stored chunk-encrypted as (b ^ i) + i
+	// and then archive-encrypted with key 190.
+	const i, key = 1, 190
+	off := 220 + 4 + binary.Size(ChunkHeader{}) + i
+	buf[off] = (('K' ^ i) + i) ^ byte(off) ^ key
+	a, err := Open(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := a.Extract("Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Kopyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Fatalf("Got %q, wanted %q", data, want)
+	}
+	a.Options.VerifyChecksums = true
+	_, err = a.ExtractList(t.TempDir(), []string{"Copyright.txt"})
+	if err == nil {
+		t.Fatal("expected a checksum error")
+	}
+	for _, want := range []string{"Copyright.txt", "chunk 0", "checksum"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+func TestExtractModTime(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(1997, time.September, 30, 12, 0, 0, 0, time.UTC)
+	a.Options.ModTime = when
+	dest := t.TempDir()
+	if _, err := a.ExtractMapped(dest); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range a.List() {
+		info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(when) {
+			t.Errorf("%s: Got %v, wanted %v", name, info.ModTime(), when)
+		}
+	}
+}
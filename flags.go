@@ -0,0 +1,86 @@
+package hpi
+
+import "io"
+
+// FlagMismatch is a file whose FileData.Flag does not match the compression
+// its chunks actually use. Extraction goes by the chunk headers, but some
+// tools trust the flag.
+type FlagMismatch struct {
+	Path   string
+	Flag   byte // FileData.Flag as stored.
+	Method byte // The CompressionMethod used by most of the file's chunks.
+}
+
+// FlagMismatches reports every file whose FileData.Flag differs from the
+// dominant compression method of its chunks. Only chunk headers are read.
+func (a *Archive) FlagMismatches() ([]FlagMismatch, error) {
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	var mismatches []FlagMismatch
+	for _, f := range files {
+		headers, err := a.decoder().chunkHeaders(f.fd)
+		if err != nil {
+			return nil, err
+		}
+		if len(headers) == 0 {
+			continue
+		}
+		if method := dominantMethod(headers); method != f.fd.Flag {
+			mismatches = append(mismatches, FlagMismatch{Path: f.name, Flag: f.fd.Flag, Method: method})
+		}
+	}
+	return mismatches, nil
+}
+
+// RepairFlags rewrites, through w, the FileData.Flag of every file in a that
+// FlagMismatches reports so that it matches its chunks. The writes go to the
+// same offsets the archive was read from, shifted by the offset given to
+// OpenAt for an embedded archive, so w must write to the archive's own
+// backing file. The repaired files are returned. It is a function rather
+// than a method because an Archive never modifies the file it reads, not
+// even through RepairFlags: a still holds the old flags, and the archive
+// must be opened again to see the repaired ones.
+func RepairFlags(a *Archive, w io.WriterAt) ([]FlagMismatch, error) {
+	mismatches, err := a.FlagMismatches()
+	if err != nil {
+		return nil, err
+	}
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]int, len(files))
+	for _, f := range files {
+		offsets[f.name] = f.offset
+	}
+	for _, m := range mismatches {
+		// The flag is the last byte of the FileData.
+		off := offsets[m.Path] + 8
+		stored := m.Method
+		if a.key != 0 {
+			stored ^= byte(off) ^ a.key
+		}
+		if _, err := w.WriteAt([]byte{stored}, a.base+int64(off)); err != nil {
+			return nil, err
+		}
+	}
+	return mismatches, nil
+}
+
+// dominantMethod returns the most common compression method among headers,
+// preferring the one that appears first when there is a tie.
+func dominantMethod(headers []ChunkHeader) byte {
+	var (
+		counts = make(map[byte]int)
+		best   = headers[0].CompressionMethod
+	)
+	for _, h := range headers {
+		counts[h.CompressionMethod]++
+		if counts[h.CompressionMethod] > counts[best] {
+			best = h.CompressionMethod
+		}
+	}
+	return best
+}
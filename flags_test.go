@@ -0,0 +1,151 @@
+package hpi
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairFlags(t *testing.T) {
+	buf, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Store 2 as the flag of Copyright.txt, whose FileData is at 69.
+	a, err := Open(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[77] = 2 ^ byte(77) ^ a.key
+	name := filepath.Join(t.TempDir(), "flags.ufo")
+	if err := os.WriteFile(name, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err := a.FlagMismatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FlagMismatch{Path: "Copyright.txt", Flag: 2, Method: 1}
+	if len(mismatches) != 1 || mismatches[0] != want {
+		t.Fatalf("Got %v, wanted %v", mismatches, want)
+	}
+	if _, err := RepairFlags(a, file); err != nil {
+		t.Fatal(err)
+	}
+	// a itself is left as it was read.
+	if f, err := a.find("Copyright.txt"); err != nil || f.fd.Flag != 2 {
+		t.Errorf("Got %v, %v, wanted the old flag %d", f.fd, err, 2)
+	}
+	a, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err = a.FlagMismatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("Got %v after repair, wanted none", mismatches)
+	}
+}
+func TestRepairFlagsEmbedded(t *testing.T) {
+	buf, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := Open(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[77] = 2 ^ byte(77) ^ a.key
+	// The archive is appended to some other data.
+	stub := []byte("a self-extractor stub")
+	buf = append(stub, buf...)
+	name := filepath.Join(t.TempDir(), "flags.exe")
+	if err := os.WriteFile(name, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	size := int64(len(buf))
+	if a, err = OpenAt(file, int64(len(stub)), size); err != nil {
+		t.Fatal(err)
+	}
+	if repaired, err := RepairFlags(a, file); err != nil || len(repaired) != 1 {
+		t.Fatalf("Got %v, %v, wanted one repaired file", repaired, err)
+	}
+	if a, err = OpenAt(file, int64(len(stub)), size); err != nil {
+		t.Fatal(err)
+	}
+	if mismatches, err := a.FlagMismatches(); err != nil || len(mismatches) != 0 {
+		t.Errorf("Got %v, %v after repair, wanted none", mismatches, err)
+	}
+	got := make([]byte, len(stub))
+	if _, err := file.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, stub) {
+		t.Errorf("Got %q, wanted the stub %q left alone", got, stub)
+	}
+}
+func TestDominantMethod(t *testing.T) {
+	headers := []ChunkHeader{{CompressionMethod: 2}, {CompressionMethod: 1}, {CompressionMethod: 1}}
+	if got := dominantMethod(headers); got != 1 {
+		t.Errorf("Got %d, wanted %d", got, 1)
+	}
+	if got := dominantMethod(headers[:2]); got != 2 {
+		t.Errorf("Got %d, wanted %d", got, 2)
+	}
+}
+func TestFlagDisagreesWithChunks(t *testing.T) {
+	buf, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := Open(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := a.Extract("Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Claim zlib for Copyright.txt, whose one chunk uses LZ77.
+	buf[77] = 2 ^ byte(77) ^ a.key
+	a, err = Open(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.find("Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, err := a.decoder().chunkHeaders(f.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.fd.Compression() != 2 || headers[0].CompressionMethod != 1 {
+		t.Fatalf("Got flag %d and method %d, wanted 2 and 1", f.fd.Compression(), headers[0].CompressionMethod)
+	}
+	// The chunk header wins.
+	got, err := a.Extract("Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+}
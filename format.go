@@ -0,0 +1,57 @@
+package hpi
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Format is the kind of file that DetectFormat found.
+type Format int
+
+const (
+	// FormatUnknown is any file that is not an HPI archive, including
+	// files too short to hold the magic.
+	FormatUnknown Format = iota
+
+	// FormatHPI is an HPI archive. Open reads those whose Save field is
+	// Version1 and rejects others with ErrUnsupportedVersion.
+	FormatHPI
+
+	// FormatSavedGame is a TA saved game, which shares the HPI header but
+	// which Open rejects with ErrUnsupportedSavedGame.
+	FormatSavedGame
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatHPI:
+		return "HPI"
+	case FormatSavedGame:
+		return "saved game"
+	}
+	return "unknown"
+}
+
+// DetectFormat identifies the file in r from its first 8 bytes, the marker
+// and the Save field of the header, without reading anything else. Only
+// errors from r are returned; a file that is not an archive is simply
+// FormatUnknown.
+func DetectFormat(r io.ReaderAt) (Format, error) {
+	var buf [8]byte
+	n, err := r.ReadAt(buf[:], 0)
+	if n < len(buf) {
+		if err == nil || err == io.EOF {
+			return FormatUnknown, nil
+		}
+		return FormatUnknown, err
+	}
+	marker := binary.LittleEndian.Uint32(buf[:])
+	save := binary.LittleEndian.Uint32(buf[4:])
+	switch {
+	case marker == SavedGame || (marker == HPIMagic && save == SavedGame):
+		return FormatSavedGame, nil
+	case marker == HPIMagic:
+		return FormatHPI, nil
+	}
+	return FormatUnknown, nil
+}
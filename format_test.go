@@ -0,0 +1,35 @@
+package hpi
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	file, err := os.Open("TADEMO.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	tests := []struct {
+		data []byte
+		want Format
+	}{
+		{[]byte("HAPI\x00\x00\x01\x00"), FormatHPI},
+		{[]byte("HAPIBANK"), FormatSavedGame},
+		{[]byte("BANK\x00\x00\x01\x00"), FormatSavedGame},
+		{[]byte("HAPI"), FormatUnknown},
+		{[]byte("PK\x03\x04\x14\x00\x00\x00"), FormatUnknown},
+		{nil, FormatUnknown},
+	}
+	for _, test := range tests {
+		got, err := DetectFormat(bytes.NewReader(test.data))
+		if err != nil || got != test.want {
+			t.Errorf("%q: Got %v, %v, wanted %v", test.data, got, err, test.want)
+		}
+	}
+	if got, err := DetectFormat(file); err != nil || got != FormatHPI {
+		t.Errorf("Got %v, %v, wanted %v", got, err, FormatHPI)
+	}
+}
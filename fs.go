@@ -0,0 +1,180 @@
+package hpi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HPIFS presents an Archive as an fs.FS, so that it can be used with
+// http.FileServer, fs.WalkDir, template.ParseFS and the like. Paths are the
+// slash-separated archive paths, matched exactly. Opening a file decompresses
+// all of it into memory.
+type HPIFS struct {
+	a     *Archive
+	nodes map[string]*fsNode
+}
+
+// fsNode is a file or directory of an HPIFS.
+type fsNode struct {
+	info     fileInfo
+	fd       FileData
+	children []fs.DirEntry // Sorted by name.
+}
+
+// NewFS indexes the directory of a and returns it as an HPIFS. It returns
+// an error wrapping ErrCorruptDirectory if an entry's name is not a single
+// path element, such as one holding a separator or one that is "." or "..".
+func NewFS(a *Archive) (*HPIFS, error) {
+	nodes := map[string]*fsNode{
+		".": {info: fileInfo{name: ".", dir: true}},
+	}
+	err := a.walk(func(name string, depth int, e Entry) error {
+		// An entry name must be a single path element, so that name is
+		// its directory's path and one more element. A name such as
+		// "sub/inner.txt", "." or ".." would otherwise land in some other
+		// directory, or in none at all.
+		if name == "." || !fs.ValidPath(name) || strings.Count(name, "/") != depth || strings.Contains(name, `\`) {
+			return fmt.Errorf("%q: %w: entry name is not a single path element", name, ErrCorruptDirectory)
+		}
+		n := &fsNode{info: fileInfo{name: path.Base(name), dir: e.Flag == 1}}
+		if !n.info.dir {
+			fd, err := a.fileData(int(e.DirDataOffset))
+			if err != nil {
+				return err
+			}
+			n.fd = fd
+			n.info.size = int64(fd.FileSize)
+		}
+		nodes[name] = n
+		parent := nodes[path.Dir(name)]
+		parent.children = append(parent.children, fs.FileInfoToDirEntry(n.info))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		sort.Slice(n.children, func(i, j int) bool {
+			return n.children[i].Name() < n.children[j].Name()
+		})
+	}
+	return &HPIFS{a: a, nodes: nodes}, nil
+}
+
+// node returns the node at name, or an *fs.PathError for op.
+func (f *HPIFS) node(op, name string) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n, ok := f.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return n, nil
+}
+
+// Open implements fs.FS.
+func (f *HPIFS) Open(name string) (fs.File, error) {
+	n, err := f.node("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.info.dir {
+		return &fsDir{info: n.info, entries: n.children}, nil
+	}
+	data, err := f.a.ReadFileAt(n.fd)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &fsFile{info: n.info, Reader: bytes.NewReader(data)}, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (f *HPIFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := f.node("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.info.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return append([]fs.DirEntry(nil), n.children...), nil
+}
+
+// Stat implements fs.StatFS.
+func (f *HPIFS) Stat(name string) (fs.FileInfo, error) {
+	n, err := f.node("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info, nil
+}
+
+// fileInfo describes a file or directory of an HPIFS. Archives store no
+// modification times or permissions, so every file is read-only and dated
+// the zero time.
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fileInfo) IsDir() bool        { return fi.dir }
+func (fi fileInfo) Sys() any           { return nil }
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// fsFile is an open file of an HPIFS. It also implements io.Seeker and
+// io.ReaderAt, which http.FileServer uses to serve ranges.
+type fsFile struct {
+	info fileInfo
+	*bytes.Reader
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *fsFile) Close() error               { return nil }
+
+// fsDir is an open directory of an HPIFS.
+type fsDir struct {
+	info    fileInfo
+	entries []fs.DirEntry
+	pos     int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *fsDir) Close() error               { return nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.pos:]
+	if n <= 0 {
+		d.pos = len(d.entries)
+		return append([]fs.DirEntry(nil), rest...), nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.pos += n
+	return append([]fs.DirEntry(nil), rest[:n]...), nil
+}
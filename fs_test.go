@@ -0,0 +1,70 @@
+package hpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestHPIFS(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFS(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "Copyright.txt", "maps/example.tnt", "maps/example.ota", "camps/useonly/example.tdf"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(fsys, "Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Copyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Errorf("Got %q, wanted %q", data, want)
+	}
+	info, err := fs.Stat(fsys, "maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 263256 || info.IsDir() {
+		t.Errorf("Got size %d and dir %v, wanted %d and false", info.Size(), info.IsDir(), 263256)
+	}
+	if info, err := fs.Stat(fsys, "camps/useonly"); err != nil || !info.IsDir() {
+		t.Errorf("Got %v, %v, wanted a directory", info, err)
+	}
+	if _, err := fsys.Open("maps/missing.tnt"); !os.IsNotExist(err) {
+		t.Errorf("Got %v, wanted a not-exist error", err)
+	}
+}
+func TestHPIFSBadName(t *testing.T) {
+	for _, name := range []string{"sub/inner.txt", ".", "..", `sub\inner.txt`, ""} {
+		var dir bytes.Buffer
+		nameOffset := uint32(headerSize + 8 + 9)
+		binary.Write(&dir, binary.LittleEndian, []uint32{1, headerSize + 8})
+		binary.Write(&dir, binary.LittleEndian, Entry{
+			NameOffset:    nameOffset,
+			DirDataOffset: nameOffset + uint32(len(name)) + 1,
+		})
+		dir.WriteString(name + "\x00")
+		binary.Write(&dir, binary.LittleEndian, FileData{})
+		a, err := Open(bytes.NewReader(withDirectory(dir.Bytes())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewFS(a); !errors.Is(err, ErrCorruptDirectory) {
+			t.Errorf("%q: Got %v, wanted %v", name, err, ErrCorruptDirectory)
+		}
+	}
+}
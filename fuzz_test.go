@@ -0,0 +1,92 @@
+package hpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+)
+
+// headerSize is where the directory starts in an archive from withDirectory.
+const headerSize = 20
+
+// withDirectory returns an unencrypted archive whose directory is dir,
+// stored right after the header as usual, and no file data.
+func withDirectory(dir []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, Header{
+		Marker:        HPIMagic,
+		Save:          Version1,
+		DirectorySize: uint32(headerSize + len(dir)),
+		Start:         headerSize,
+	})
+	buf.Write(dir)
+	return buf.Bytes()
+}
+func FuzzDecompress(f *testing.F) {
+	f.Add(Compress([]byte("Total Annihilation Total Annihilation")), uint32(38))
+	f.Add(Compress(bytes.Repeat([]byte{0}, 5000)), uint32(5000))
+	f.Add([]byte{0x00, 'a', 'b', 'c'}, uint32(0xfffffff0))
+	archive, err := os.Open("Example.ufo")
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer archive.Close()
+	a, err := Open(archive)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range []string{"Copyright.txt", "maps/example.ota"} {
+		fi, err := a.find(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		chunks, err := ReadChunks(archive, a.key, fi.fd)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, c := range chunks {
+			if c.CompressionMethod == 1 {
+				f.Add(c.Data, c.DecompressedSize)
+			}
+		}
+	}
+	f.Fuzz(func(t *testing.T, input []byte, size uint32) {
+		data, err := Decompress(input, int(size))
+		if err == nil && len(data) != int(size) {
+			t.Errorf("Got %d bytes, wanted %d", len(data), size)
+		}
+		streamed, streamErr := io.ReadAll(NewDecompressor(bytes.NewReader(input), int(size)))
+		if (err == nil) != (streamErr == nil) || err == nil && !bytes.Equal(streamed, data) {
+			t.Errorf("Got %x, %v from NewDecompressor, wanted %x, %v", streamed, streamErr, data, err)
+		}
+		data, err = Decompress(Compress(input), len(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, input) {
+			t.Errorf("Got %x, wanted %x", data, input)
+		}
+	})
+}
+func FuzzTraverse(f *testing.F) {
+	_, _, dir, offset := openDirectory(f, "Example.ufo")
+	valid := make([]byte, dir.Len()-offset)
+	dir.ReadAt(valid, int64(offset))
+	f.Add(valid)
+	f.Add(wideDirectory(3, true))
+	f.Fuzz(func(t *testing.T, dir []byte) {
+		archive := withDirectory(dir)
+		padded := append(make([]byte, headerSize), dir...)
+		EachEntry(bytes.NewReader(padded), 0, headerSize, func(string, bool) error {
+			return nil
+		})
+		Totals(bytes.NewReader(padded), 0, headerSize)
+		a, err := Open(bytes.NewReader(archive))
+		if err != nil {
+			return
+		}
+		a.ListWithDepth()
+	})
+}
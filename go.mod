@@ -1,3 +1,3 @@
 module github.com/cosmouser/hpi
 
-go 1.14
+go 1.20
@@ -0,0 +1,140 @@
+package hpi
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+// contentHash returns the hex SHA-256 of f's decompressed contents. The
+// contents are streamed through the hash and also copied to w if it is not
+// nil, so files never need to be held in memory to be hashed.
+func (a *Archive) contentHash(f archiveFile, w io.Writer) (string, error) {
+	h := sha256.New()
+	out := io.Writer(h)
+	if w != nil {
+		out = io.MultiWriter(h, w)
+	}
+	if err := a.decoder().decodeFile(f.fd, out); err != nil {
+		return "", fmt.Errorf("%s: %w", f.name, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyAgainst checks the archive against a manifest mapping archive paths
+// to hex SHA-256 hashes, such as the one written by ExtractObjects. It
+// returns, sorted, the paths whose contents do not match, as the archive
+// spells them, and the paths that are missing from the archive, as the
+// manifest does. Paths are compared as by Extract. Files that the manifest
+// does not list are not checked.
+func (a *Archive) VerifyAgainst(manifest map[string]string) ([]string, error) {
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]archiveFile, len(files))
+	for _, f := range files {
+		byName[a.pathKey(f.name)] = f
+	}
+	var (
+		bad      []string
+		sums     = make(map[string]string, len(manifest))
+		mismatch = make(map[string]bool)
+	)
+	for name, want := range manifest {
+		f, ok := byName[a.pathKey(name)]
+		if !ok {
+			bad = append(bad, name)
+			continue
+		}
+		sum, ok := sums[f.name]
+		if !ok {
+			if sum, err = a.contentHash(f, nil); err != nil {
+				return nil, err
+			}
+			sums[f.name] = sum
+		}
+		if !strings.EqualFold(sum, want) && !mismatch[f.name] {
+			mismatch[f.name] = true
+			bad = append(bad, f.name)
+		}
+	}
+	sort.Strings(bad)
+	return bad, nil
+}
+
+// ChangedFrom returns, in directory order, the paths of the files in a that
+// are not in base or whose contents differ from base's. Files that only
+// base has are not listed, so the result is exactly what an update patch
+// from base to a must carry. Paths are compared as by a's Extract. Sizes
+// are compared first, and contents are only hashed when the sizes match.
+func (a *Archive) ChangedFrom(base *Archive) ([]string, error) {
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	baseFiles, err := base.files()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]archiveFile, len(baseFiles))
+	for _, f := range baseFiles {
+		byName[a.pathKey(f.name)] = f
+	}
+	var changed []string
+	for _, f := range files {
+		old, ok := byName[a.pathKey(f.name)]
+		if !ok || old.fd.FileSize != f.fd.FileSize {
+			changed = append(changed, f.name)
+			continue
+		}
+		sum, err := a.contentHash(f, nil)
+		if err != nil {
+			return nil, err
+		}
+		oldSum, err := base.contentHash(old, nil)
+		if err != nil {
+			return nil, err
+		}
+		if sum != oldSum {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed, nil
+}
+
+// TOCChecksum returns a CRC-32 of the archive's table of contents: the path,
+// decompressed size and compression method (FileData.Flag) of every file,
+// sorted by path. Paths are compared as lookups compare them, so unless
+// Options.ExactPaths is set they are normalized first and archives whose
+// names differ only in case have the same checksum. Archives with the same
+// layout have the same checksum whatever their key, directory order or file
+// contents, and only the directory is read to compute it.
+func (a *Archive) TOCChecksum() (uint32, error) {
+	files, err := a.files()
+	if err != nil {
+		return 0, err
+	}
+	type keyed struct {
+		key string
+		f   archiveFile
+	}
+	sorted := make([]keyed, len(files))
+	for i, f := range files {
+		sorted[i] = keyed{a.pathKey(f.name), f}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+	h := crc32.NewIEEE()
+	for _, k := range sorted {
+		h.Write([]byte(k.key))
+		h.Write([]byte{0})
+		binary.Write(h, binary.LittleEndian, k.f.fd.FileSize)
+		h.Write([]byte{k.f.fd.Flag})
+	}
+	return h.Sum32(), nil
+}
@@ -0,0 +1,229 @@
+package hpi
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyAgainst(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := map[string]string{
+		"COPYRIGHT.TXT":             "1FF5BC57B9D6ACEE4805837595F06E661175B6F12F20134755C0E7F692CE784B",
+		"camps/useonly/example.tdf": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		`maps\example.ota`:          "0000000000000000000000000000000000000000000000000000000000000000",
+		"units/missing.fbi":         "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}
+	bad, err := a.VerifyAgainst(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"maps/example.ota", "units/missing.fbi"}
+	if len(bad) != len(want) {
+		t.Fatalf("Got %v, wanted %v", bad, want)
+	}
+	for i := range want {
+		if bad[i] != want[i] {
+			t.Errorf("Got %s, wanted %s", bad[i], want[i])
+		}
+	}
+}
+func TestTOCChecksum(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	src, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := src.TOCChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A copy with another key and directory order has the same layout.
+	out, err := os.Create(filepath.Join(t.TempDir(), "copy.hpi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := NewWriter(out, 0)
+	for _, name := range []string{"maps/example.ota", "camps/useonly/example.tdf", "Copyright.txt", "maps/example.tnt"} {
+		if err := CopyFile(w, src, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := dst.TOCChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Got %x, wanted %x", got, want)
+	}
+	other, err := os.Open("TADEMO.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	b, err := Open(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.TOCChecksum(); err != nil || got == want {
+		t.Errorf("Got %x, %v for a different archive", got, err)
+	}
+}
+func TestTOCChecksumCase(t *testing.T) {
+	data := []byte("Total Annihilation")
+	archive := func(name string) *Archive {
+		out, err := os.Create(filepath.Join(t.TempDir(), "case.hpi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { out.Close() })
+		w := NewWriter(out, 0)
+		if err := w.AddFile(name, data, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		a, err := Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	lower, upper := archive("maps/example.ota"), archive("MAPS/EXAMPLE.OTA")
+	want, err := lower.TOCChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := upper.TOCChecksum(); err != nil || got != want {
+		t.Errorf("Got %x, %v, wanted %x", got, err, want)
+	}
+	// With ExactPaths the names are hashed as stored.
+	lower.Options.ExactPaths, upper.Options.ExactPaths = true, true
+	if want, err = lower.TOCChecksum(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := upper.TOCChecksum(); err != nil || got == want {
+		t.Errorf("Got %x, %v with ExactPaths, wanted a different checksum", got, err)
+	}
+}
+func TestChangedFrom(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	base, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(filepath.Join(t.TempDir(), "patch.hpi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := NewWriter(out, 0)
+	for _, name := range []string{"Copyright.txt", "maps/example.ota"} {
+		if err := CopyFile(w, base, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := a.ChangedFrom(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("Got %v, wanted no changes", changed)
+	}
+	// Paths are compared as by Extract, so renaming a file is no change.
+	data, err := base.Extract("Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed, err := os.Create(filepath.Join(t.TempDir(), "renamed.hpi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer renamed.Close()
+	w = NewWriter(renamed, 0)
+	if err := w.AddFile("COPYRIGHT.TXT", data, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := r.ChangedFrom(base); err != nil || len(changed) != 0 {
+		t.Errorf("Got %v, %v, wanted no changes", changed, err)
+	}
+	// Turn the first literal of the LZ77 chunk, after its flag byte, from
+	// 'C' into 'K'. The chunk is encrypted, with byte i stored as
+	// (b ^ i) + i.
+	f, err := a.find("Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const i = 1
+	off := int64(f.fd.DataOffset) + 4 + int64(binary.Size(ChunkHeader{})) + i
+	if _, err := out.WriteAt([]byte{('K' ^ i) + i}, off); err != nil {
+		t.Fatal(err)
+	}
+	data, err = a.ReadFileAt(f.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Kopyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Fatalf("Got %q, wanted %q", data, want)
+	}
+	changed, err = a.ChangedFrom(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0] != "Copyright.txt" {
+		t.Errorf("Got %v, wanted [Copyright.txt]", changed)
+	}
+	changed, err = base.ChangedFrom(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Copyright.txt", "maps/example.tnt", "camps/useonly/example.tdf"}
+	if len(changed) != len(want) {
+		t.Fatalf("Got %v, wanted %v", changed, want)
+	}
+	for i := range want {
+		if changed[i] != want[i] {
+			t.Errorf("Got %s, wanted %s", changed[i], want[i])
+		}
+	}
+}
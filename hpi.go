@@ -4,11 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -18,16 +25,90 @@ const (
 	// SavedGame is BANK in ASCII when the file is a saved game.
 	SavedGame = 0x4B4E4142
 
+	// Version1 is the Save field of the archives that TA reads, with an
+	// XOR-encrypted directory. It is the only version this package reads.
+	Version1 = 0x00010000
+
+	// Version2 is the Save field of the later archive layout used by TA:
+	// Kingdoms, whose header continues with more fields and whose
+	// directory is compressed.
+	Version2 = 0x00020000
+
 	// ChunkStart is SQSH in ASCII. It always begins the chunk header.
 	ChunkStart = 0x48535153
 )
 
+// ErrUnsupportedSavedGame is returned for TA saved games, which share the
+// HPI header but mark it with SavedGame and lay out the rest differently.
+var ErrUnsupportedSavedGame = errors.New("saved games are not supported")
+
+// ErrUnsupportedVersion is returned, wrapped with the version found, for
+// archives whose Save field is not Version1, such as Version2 archives.
+var ErrUnsupportedVersion = errors.New("unsupported HPI version")
+
+// Errors for common failures, which are returned wrapped with details such
+// as the path of the file concerned. Use errors.Is to test for them.
+var (
+	// ErrBadMagic is returned for files that do not start with HPIMagic.
+	ErrBadMagic = errors.New("not an HPI archive: bad magic")
+
+	// ErrShortRead is returned when a chunk holds less data than its
+	// header says.
+	ErrShortRead = errors.New("short read")
+
+	// ErrUnknownCompression matches every UnknownCompressionError.
+	ErrUnknownCompression = errors.New("unknown compression method")
+
+	// ErrChecksumMismatch is returned when a chunk's data does not add up
+	// to the Checksum in its header.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrNotFound is returned when a path is not in the archive.
+	ErrNotFound = errors.New("file not found in archive")
+
+	// ErrCorruptDirectory is returned when a directory node, entry or name
+	// lies outside the directory.
+	ErrCorruptDirectory = errors.New("corrupt directory")
+)
+
+// UnknownCompressionError is returned for chunks whose compression method
+// is neither built in nor registered with RegisterDecompressor.
+type UnknownCompressionError struct {
+	Method byte
+}
+
+func (e *UnknownCompressionError) Error() string {
+	return fmt.Sprintf("unknown compression method: %x", e.Method)
+}
+
+// Is makes errors.Is(err, ErrUnknownCompression) true.
+func (e *UnknownCompressionError) Is(target error) bool {
+	return target == ErrUnknownCompression
+}
+
+// Parameters of the file data format.
+const (
+	// MaxChunkSize is how much data a chunk holds once decompressed. Every
+	// chunk of a file holds this much except the last, which holds the
+	// rest, so a file of n bytes has n/MaxChunkSize chunks, rounded up.
+	MaxChunkSize = 65536
+
+	// ChunkTableEntrySize is the size of each entry in the table at the
+	// start of a file's data, a little-endian uint32 giving the stored size
+	// of one chunk, header included. The chunks follow the table.
+	ChunkTableEntrySize = 4
+
+	// WindowSize is the size of the LZ77 sliding window. Back-references
+	// give a position in it in 12 bits.
+	WindowSize = 4096
+)
+
 // Header is the only unencrypted part of the file.
 type Header struct {
 	Marker        uint32
 	Save          uint32
 	DirectorySize uint32 // This includes the size of the header.
-	Key           uint32 // The decryption key.
+	Key           uint32 // The decryption key, or 0 for an unencrypted archive. See GetKey.
 	Start         uint32
 }
 
@@ -42,7 +123,16 @@ type Entry struct {
 type FileData struct {
 	DataOffset uint32
 	FileSize   uint32
-	Flag       byte // 0: No Compression, 1: LZ77, 2: ZLib
+	Flag       byte // 0: No Compression, 1: LZ77, 2: ZLib; see Compression.
+}
+
+// Compression returns the compression method recorded for the file in the
+// directory: 0 for none, 1 for LZ77 or 2 for zlib. It is only a hint. Each
+// chunk names its own method in ChunkHeader.CompressionMethod, and that is
+// what extraction uses, so when the two disagree the chunk header wins.
+// FlagMismatches finds such files.
+func (fd FileData) Compression() byte {
+	return fd.Flag
 }
 
 // ChunkHeader provides instructions for loading the chunk.
@@ -50,7 +140,7 @@ type ChunkHeader struct {
 	Marker            uint32
 	_                 byte
 	CompressionMethod byte
-	Encrypted         byte
+	Encrypted         byte // Whether Data needs Decrypt, whatever the archive's key.
 	CompressedSize    uint32
 	DecompressedSize  uint32
 	Checksum          uint32
@@ -62,75 +152,414 @@ type Chunk struct {
 	Data []byte
 }
 
-// ReadAndDecrypt reads and decrypts buffSize bytes from the HPI file.
+// ReadAndDecrypt reads and decrypts size bytes at offset in the HPI file. It
+// returns io.ErrUnexpectedEOF if fewer than size bytes are available. A key
+// of 0 means the archive is not encrypted, and the bytes are returned as
+// read. Chunks have their own encryption, which this does not remove.
 func ReadAndDecrypt(reader io.ReadSeeker, key byte, size, offset int) ([]byte, error) {
-	seed, err := reader.Seek(int64(offset), io.SeekStart)
+	if _, err := reader.Seek(int64(offset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	DecryptInPlace(buf, key, offset)
+	return buf, nil
+}
+
+// ReadAndDecryptAt is ReadAndDecrypt for an io.ReaderAt. Since no seek
+// position is shared, many regions of one *os.File can be read at once.
+func ReadAndDecryptAt(r io.ReaderAt, key byte, size, offset int) ([]byte, error) {
+	buf, err := readAt(r, size, offset)
 	if err != nil {
 		return nil, err
 	}
+	DecryptInPlace(buf, key, offset)
+	return buf, nil
+}
+
+// readAt reads exactly size bytes at offset.
+func readAt(r io.ReaderAt, size, offset int) ([]byte, error) {
 	buf := make([]byte, size)
-	if _, err := reader.Read(buf); err != nil {
+	if err := readFull(r, buf, offset); err != nil {
 		return nil, err
 	}
+	return buf, nil
+}
+
+// readFull fills buf from offset.
+func readFull(r io.ReaderAt, buf []byte, offset int) error {
+	if n, err := r.ReadAt(buf, int64(offset)); n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// DecryptInPlace decrypts buf, which was read from offset in the HPI file,
+// with the key from Header.GetKey. Applying it again encrypts buf.
+func DecryptInPlace(buf []byte, key byte, offset int) {
 	if key == 0 {
-		return buf, nil
+		return
+	}
+	if len(buf) < 64 {
+		for i := range buf {
+			tkey := byte(offset+i) ^ key
+			buf[i] = tkey ^ buf[i]
+		}
+		return
+	}
+	// The byte at offset is XORed with byte(offset)^key, so the stream of
+	// key bytes repeats every 256 bytes. Lay out one period and the start
+	// of the next so that any 8 consecutive key bytes can be read as one
+	// word.
+	var pad [256 + 8]byte
+	for i := range pad {
+		pad[i] = byte(i) ^ key
+	}
+	pos := int(byte(offset))
+	for len(buf) >= 8 {
+		v := binary.LittleEndian.Uint64(buf) ^ binary.LittleEndian.Uint64(pad[pos:])
+		binary.LittleEndian.PutUint64(buf, v)
+		buf = buf[8:]
+		pos = (pos + 8) & 0xff
 	}
 	for i := range buf {
-		tkey := byte(int(seed)+(i)) ^ key
-		buf[i] = tkey ^ buf[i]
+		buf[i] ^= pad[pos+i]
 	}
-	return buf, nil
 }
 
-// CalculateKey calculates the decryption key from the header's Key field.
+// seekerAt adapts an io.ReadSeeker to io.ReaderAt by serializing seeks.
+type seekerAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (s *seekerAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.r, p)
+}
+
+// GetKey calculates the decryption key from the header's Key field. A key
+// of 0 means the directory and file data are stored as they are, as in
+// TADEMO.ufo, although chunks may still be encrypted on their own; see
+// Chunk.Decrypt. Only the low 14 bits of the field count, and bits 8 to 13
+// are ORed into the key, so more than one field value gives each key;
+// KeyToHeaderField returns the one below 256.
 func (h Header) GetKey() byte {
 	return byte((h.Key << 2) | (h.Key >> 6))
 }
 
-// TraverseTree traverses the HPI directory tree.
+// KeyToHeaderField returns the Header.Key value for which GetKey returns k.
+// For a field below 256, GetKey rotates the low byte left by two bits, so
+// every key has exactly one such field and KeyToHeaderField rotates it back.
+// A key of 0 gives a field of 0, which marks an unencrypted archive.
+func KeyToHeaderField(k byte) uint32 {
+	return uint32(k>>2 | k<<6)
+}
+
+// ValidateHeader checks that h is the header of an HPI archive, returning a
+// descriptive error if it is not. It cannot check the offsets against the
+// length of the file; Open does that as well.
+func ValidateHeader(h Header) error {
+	if h.Marker == SavedGame || (h.Marker == HPIMagic && h.Save == SavedGame) {
+		return ErrUnsupportedSavedGame
+	}
+	if h.Marker != HPIMagic {
+		return fmt.Errorf("%w 0x%08x", ErrBadMagic, h.Marker)
+	}
+	if h.Save != Version1 {
+		return fmt.Errorf("%w 0x%08x", ErrUnsupportedVersion, h.Save)
+	}
+	if size := uint32(binary.Size(h)); h.Start < size {
+		return fmt.Errorf("not an HPI archive: directory start %d is inside the %d-byte header", h.Start, size)
+	}
+	if h.DirectorySize < h.Start {
+		return fmt.Errorf("not an HPI archive: directory size %d is smaller than start %d", h.DirectorySize, h.Start)
+	}
+	return nil
+}
+
+// chunkSize returns the decompressed size of a full chunk for the header's
+// archive variant. Every known variant uses MaxChunkSize.
+func (h Header) chunkSize() int {
+	return MaxChunkSize
+}
+
+// TraverseTree traverses the HPI directory tree. A directory that lists the
+// same name twice is rejected rather than extracted one entry over another,
+// unless ExtractOptions.Duplicates given to TraverseTreeOptions says which
+// to use, as is any entry whose name is absolute or has a ".." component and so
+// would be written outside parent. An error extracting a file names its
+// path and the directory offset of its FileData.
 func TraverseTree(archive, dir io.ReadSeeker, key byte, parent string, offset int) error {
-	var (
-		numEntries  uint32
-		entryOffset uint32
-	)
-	if _, err := dir.Seek(int64(offset), io.SeekStart); err != nil {
+	return TraverseTreeContext(context.Background(), archive, dir, key, parent, offset)
+}
+
+// TraverseTreeContext is TraverseTree that stops with ctx.Err() once ctx is
+// done. It checks ctx before each file and each chunk, and removes the file
+// it was writing when cancelled.
+func TraverseTreeContext(ctx context.Context, archive, dir io.ReadSeeker, key byte, parent string, offset int) error {
+	return TraverseTreeOptions(ctx, archive, dir, key, parent, offset, ExtractOptions{})
+}
+
+// TraverseTreeOptions is TraverseTreeContext that extracts each file with
+// ProcessFileOptions and opts. Of opts, VerifyChecksums, Progress, Timings,
+// Recover, Duplicates, ModTime, DirMode, FileMode, Sink, ContinueOnError
+// and Skip apply. Rename, Quarantine, ExactPaths and SkipMissing only apply
+// to an Archive, and TraverseTreeOptions returns an error if any is set
+// rather than extracting without them, naming the first set in that order.
+func TraverseTreeOptions(ctx context.Context, archive, dir io.ReadSeeker, key byte, parent string, offset int, opts ExtractOptions) error {
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"Rename", opts.Rename != nil},
+		{"Quarantine", opts.Quarantine},
+		{"ExactPaths", opts.ExactPaths},
+		{"SkipMissing", opts.SkipMissing},
+	} {
+		if o.set {
+			return fmt.Errorf("ExtractOptions.%s is not supported by TraverseTreeOptions", o.name)
+		}
+	}
+	return traverseTree(ctx, archive, dir, key, parent, "", offset, opts, seenDirs{})
+}
+
+// traverseTree is TraverseTreeOptions for the directory whose path in the
+// archive is dirPath, in a walk that has already been into the directories
+// in seen.
+func traverseTree(ctx context.Context, archive, dir io.ReadSeeker, key byte, parent, dirPath string, offset int, opts ExtractOptions, seen seenDirs) error {
+	entries, names, err := readDirectory(dir, offset)
+	if err != nil {
 		return err
 	}
-	if err := binary.Read(dir, binary.LittleEndian, &numEntries); err != nil {
+	if err := seen.enter(offset, entries); err != nil {
 		return err
 	}
-	if err := binary.Read(dir, binary.LittleEndian, &entryOffset); err != nil {
+	entries, names, err = dedupe(parent, entries, names, opts.Duplicates)
+	if err != nil {
 		return err
 	}
-	for i := 0; i < int(numEntries); i++ {
-		if _, err := dir.Seek(int64(entryOffset)+int64(i*9), io.SeekStart); err != nil {
+	var errs []error
+	for i, entry := range entries {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		var entry Entry
-		if err := binary.Read(dir, binary.LittleEndian, &entry); err != nil {
-			return err
+		name := path.Join(parent, names[i])
+		if unsafePath(names[i]) || !within(parent, name) {
+			return fmt.Errorf("%q: entry name escapes the extraction directory %s", names[i], parent)
 		}
-		if _, err := dir.Seek(int64(entry.NameOffset), io.SeekStart); err != nil {
-			return err
+		archivePath := path.Join(dirPath, names[i])
+		if opts.Skip != nil && opts.Skip(archivePath, entry.Flag == 1) {
+			continue
+		}
+		if entry.Flag == 1 {
+			err = traverseTree(ctx, archive, dir, key, name, archivePath, int(entry.DirDataOffset), opts, seen)
+		} else if err = opts.sink().Mkdir(filepath.Dir(name)); err == nil {
+			err = ProcessFileOptions(ctx, archive, dir, key, name, int(entry.DirDataOffset), opts)
+			if err != nil && ctx.Err() == nil {
+				err = fmt.Errorf("processing %q at offset %d: %w", name, entry.DirDataOffset, err)
+			}
 		}
-		nameReader := bufio.NewReader(dir)
-		fileName, err := nameReader.ReadBytes(0)
 		if err != nil {
-			return err
+			if !opts.ContinueOnError || ctx.Err() != nil {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Walk calls fn with the path and FileData of every file in the archive,
+// in directory order, without extracting anything. dir is the decrypted
+// directory as given to TraverseTree, and the root directory is found from
+// the header of archive. key is not needed to read a decrypted directory
+// and is accepted so that Walk takes the same arguments as TraverseTree.
+func Walk(archive, dir io.ReadSeeker, key byte, fn func(path string, fd FileData) error) error {
+	header, err := readHeader(archive)
+	if err != nil {
+		return err
+	}
+	return walkTree(dir, "", int(header.Start), fn, seenDirs{})
+}
+
+// LoadDirectory reads the header of the HPI file in r and decrypts its
+// directory, returning the header, the key and a reader for the directory
+// that TraverseTree, Walk and the other free functions accept. The reader
+// starts with Start zero bytes in place of the header, so that offsets into
+// it are the offsets stored in the file.
+func LoadDirectory(r io.ReadSeeker) (header Header, key byte, dir *bytes.Reader, err error) {
+	if header, err = readHeader(r); err != nil {
+		return header, 0, nil, fmt.Errorf("not an HPI archive: reading header: %w", err)
+	}
+	if err := ValidateHeader(header); err != nil {
+		return header, 0, nil, err
+	}
+	key = header.GetKey()
+	buf, err := ReadAndDecrypt(r, key, int(header.DirectorySize-header.Start), int(header.Start))
+	if err != nil {
+		return header, 0, nil, fmt.Errorf("directory: %w", err)
+	}
+	return header, key, bytes.NewReader(append(make([]byte, int(header.Start)), buf...)), nil
+}
+
+// ExtractAll extracts every file in the HPI file called archivePath below
+// destDir, which is created if it does not exist. It is TraverseTree with
+// the header and directory read for you.
+func ExtractAll(archivePath, destDir string) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header, key, dir, err := LoadDirectory(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", archivePath, err)
+	}
+	if err := os.MkdirAll(destDir, 0744); err != nil {
+		return err
+	}
+	return TraverseTree(file, dir, key, destDir, int(header.Start))
+}
+
+// readHeader reads the header at the start of archive.
+func readHeader(archive io.ReadSeeker) (Header, error) {
+	var header Header
+	buf, err := readAt(&seekerAt{r: archive}, binary.Size(header), 0)
+	if err != nil {
+		return header, err
+	}
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header)
+	return header, err
+}
+
+// ExtractGlob extracts the files whose paths match pattern into dest and
+// returns their paths in directory order. Patterns use the syntax of
+// path.Match and, as in TA, are matched case-insensitively against the
+// whole slash-separated path, so "*.tdf" only matches files in the root
+// and "units/*" only files directly in units. Files that do not match are
+// not read at all.
+func ExtractGlob(archive, dir io.ReadSeeker, key byte, dest, pattern string) ([]string, error) {
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%q: %w", pattern, err)
+	}
+	var files []archiveFile
+	err := Walk(archive, dir, key, func(name string, fd FileData) error {
+		if ok, _ := path.Match(pattern, strings.ToLower(name)); ok {
+			files = append(files, archiveFile{name: name, fd: fd})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	a := fileArchive(archive, key)
+	var extracted []string
+	for _, f := range files {
+		if err := a.extractFile(dest, f); err != nil {
+			return extracted, err
 		}
-		name := path.Join(parent, string(fileName[:len(fileName)-1]))
+		extracted = append(extracted, f.name)
+	}
+	return extracted, nil
+}
+
+// walkTree is Walk for the directory at offset, whose path is parent.
+func walkTree(dir io.ReadSeeker, parent string, offset int, fn func(path string, fd FileData) error, seen seenDirs) error {
+	entries, names, err := readDirectory(dir, offset)
+	if err != nil {
+		return err
+	}
+	if err := seen.enter(offset, entries); err != nil {
+		return err
+	}
+	if _, _, err := dedupe(parent, entries, names, DuplicatesError); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		name := path.Join(parent, names[i])
 		if entry.Flag == 1 {
-			if err := TraverseTree(archive, dir, key, name, int(entry.DirDataOffset)); err != nil {
+			if err := walkTree(dir, name, int(entry.DirDataOffset), fn, seen); err != nil {
 				return err
 			}
-		} else {
-			if _, err := os.Stat(parent); os.IsNotExist(err) {
-				err = os.MkdirAll(parent, 0744)
-				if err != nil {
-					return err
-				}
-			}
-			if err := ProcessFile(archive, dir, key, name, int(entry.DirDataOffset)); err != nil {
+			continue
+		}
+		var fd FileData
+		if _, err := dir.Seek(int64(entry.DirDataOffset), io.SeekStart); err != nil {
+			return err
+		}
+		if err := binary.Read(dir, binary.LittleEndian, &fd); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := fn(name, fd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TotalSize returns the decompressed size of every file in the decrypted
+// directory dir, whose root is at start, without reading any file data.
+// It is how much disk space TraverseTree needs. key is accepted so that
+// TotalSize takes the same arguments as the other directory functions.
+func TotalSize(dir io.ReadSeeker, key byte, start int) (int64, error) {
+	size, _, err := Totals(dir, key, start)
+	return size, err
+}
+
+// Totals is TotalSize that also returns the number of files.
+func Totals(dir io.ReadSeeker, key byte, start int) (size int64, files int, err error) {
+	err = walkTree(dir, "", start, func(_ string, fd FileData) error {
+		size += int64(fd.FileSize)
+		files++
+		return nil
+	}, seenDirs{})
+	return size, files, err
+}
+
+// EachEntry calls fn with the path of every entry in the decrypted directory
+// dir, whose root is at start, and whether it is a directory. Directories
+// come before their contents. It reads only names and flags, not FileData
+// or file contents, so it is a cheap way to index an archive. key is
+// accepted so that EachEntry takes the same arguments as the other
+// directory functions. If fn returns an error, EachEntry stops and returns
+// it.
+func EachEntry(dir io.ReadSeeker, key byte, start int, fn func(path string, isDir bool) error) error {
+	return eachEntry(dir, "", start, fn, seenDirs{})
+}
+
+// eachEntry is EachEntry for the directory at offset, whose path is parent.
+func eachEntry(dir io.ReadSeeker, parent string, offset int, fn func(path string, isDir bool) error, seen seenDirs) error {
+	entries, names, err := readDirectory(dir, offset)
+	if err != nil {
+		return err
+	}
+	if err := seen.enter(offset, entries); err != nil {
+		return err
+	}
+	if _, _, err := dedupe(parent, entries, names, DuplicatesError); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		name := path.Join(parent, names[i])
+		if err := fn(name, entry.Flag == 1); err != nil {
+			return err
+		}
+		if entry.Flag == 1 {
+			if err := eachEntry(dir, name, int(entry.DirDataOffset), fn, seen); err != nil {
 				return err
 			}
 		}
@@ -138,39 +567,412 @@ func TraverseTree(archive, dir io.ReadSeeker, key byte, parent string, offset in
 	return nil
 }
 
-// ProcessFile decrypts and decompresses a file in the archive.
-func ProcessFile(archive, dir io.ReadSeeker, key byte, name string, offset int) error {
+// NormalizePath returns the form of an archive path that lookups compare
+// by default. TA matches names case-insensitively and its tools wrote
+// backslash separators, so the path is lowercased, backslashes become
+// forward slashes, and leading and trailing separators are dropped:
+// `gamedata\SIDEDATA.TDF` and `gamedata/sidedata.tdf` are the same path.
+func NormalizePath(name string) string {
+	return strings.Trim(strings.ToLower(strings.ReplaceAll(name, `\`, "/")), "/")
+}
+
+// FindEntry looks up the file at targetPath in the decrypted directory dir,
+// whose root is at start, without reading anything else. Paths are
+// compared after NormalizePath; use FindEntryExact to match them exactly.
+// dir is laid out as for TraverseTree, so key is not needed to read it. The
+// bool reports whether the file was found; a directory at targetPath does
+// not count.
+func FindEntry(dir io.ReadSeeker, key byte, start int, targetPath string) (FileData, bool, error) {
+	return findEntry(dir, start, targetPath, NormalizePath)
+}
+
+// FindEntryExact is FindEntry for a slash-separated targetPath whose
+// components must match the stored names exactly.
+func FindEntryExact(dir io.ReadSeeker, key byte, start int, targetPath string) (FileData, bool, error) {
+	return findEntry(dir, start, targetPath, func(name string) string { return name })
+}
+
+// Stat returns the FileData of the file at targetPath in the decrypted
+// directory dir, whose root is at start, giving its size, compression and where its data is,
+// without reading the data. Paths are compared as by FindEntry. It returns
+// an error wrapping ErrNotFound if there is no such file, including when
+// targetPath is a directory.
+func Stat(dir io.ReadSeeker, key byte, start int, targetPath string) (FileData, error) {
+	fd, ok, err := FindEntry(dir, key, start, targetPath)
+	if err != nil {
+		return FileData{}, err
+	}
+	if !ok {
+		return FileData{}, fmt.Errorf("%s: %w", targetPath, ErrNotFound)
+	}
+	return fd, nil
+}
+
+// findEntry is FindEntry comparing names after applying pathKey.
+func findEntry(dir io.ReadSeeker, start int, targetPath string, pathKey func(string) string) (FileData, bool, error) {
 	var (
-		header    FileData
-		chunk     Chunk
-		numChunks int
-		sizes     []uint32
-		chunkSum  int
-		out       *os.File
+		fd     FileData
+		offset = start
+		parts  = strings.Split(pathKey(targetPath), "/")
 	)
-	const (
-		longLength   = 4
-		maxChunkSize = 65536
+	for i, part := range parts {
+		entries, names, err := readDirectory(dir, offset)
+		if err != nil {
+			return fd, false, err
+		}
+		j := 0
+		for j < len(names) && pathKey(names[j]) != part {
+			j++
+		}
+		last := i == len(parts)-1
+		if j == len(names) || (entries[j].Flag == 1) == last {
+			return fd, false, nil
+		}
+		offset = int(entries[j].DirDataOffset)
+	}
+	if _, err := dir.Seek(int64(offset), io.SeekStart); err != nil {
+		return fd, false, err
+	}
+	if err := binary.Read(dir, binary.LittleEndian, &fd); err != nil {
+		return fd, false, err
+	}
+	return fd, true, nil
+}
+
+// ExtractPath returns the decompressed contents of the file at targetPath,
+// found as by FindEntry in the directory whose root is at start.
+func ExtractPath(archive, dir io.ReadSeeker, key byte, start int, targetPath string) ([]byte, error) {
+	fd, ok, err := FindEntry(dir, key, start, targetPath)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", targetPath, ErrNotFound)
+	}
+	data, err := fileArchive(archive, key).ReadFileAt(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", targetPath, err)
+	}
+	return data, nil
+}
+
+// seenDirs records the directories that a walk has been into. A damaged or
+// crafted directory can list itself or one of its parents as a
+// subdirectory, which would recurse forever, or list the same subdirectory
+// many times over, which takes time exponential in the depth.
+type seenDirs map[int]bool
+
+// enter records the directory at offset, whose entries are given, and
+// returns an error if the walk has been into it before. Empty directories
+// lead nowhere and may be shared.
+func (s seenDirs) enter(offset int, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if s[offset] {
+		return fmt.Errorf("directory at offset %d is listed more than once", offset)
+	}
+	s[offset] = true
+	return nil
+}
+
+// checkEntryTable returns an ErrCorruptDirectory error if numEntries
+// entries at entryOffset do not fit in a directory of size bytes. This also
+// bounds numEntries, so that a damaged count cannot make the caller
+// allocate more entries than the directory could hold.
+func checkEntryTable(numEntries, entryOffset, size int64) error {
+	const entrySize = 9
+	if entryOffset+numEntries*entrySize > size {
+		return fmt.Errorf("%w: %d entries at offset %d run past the end of the %d-byte directory", ErrCorruptDirectory, numEntries, entryOffset, size)
+	}
+	return nil
+}
+
+// checkEntries returns an ErrCorruptDirectory error for the first of
+// entries whose name, or whose FileData or directory node, does not start
+// within a directory of size bytes.
+func checkEntries(entries []Entry, size int64) error {
+	for i, e := range entries {
+		dataSize := int64(binary.Size(FileData{}))
+		if e.Flag == 1 {
+			dataSize = 8
+		}
+		if int64(e.NameOffset) >= size {
+			return fmt.Errorf("%w: entry %d: name offset %d is past the end of the %d-byte directory", ErrCorruptDirectory, i, e.NameOffset, size)
+		}
+		if int64(e.DirDataOffset)+dataSize > size {
+			return fmt.Errorf("%w: entry %d: data offset %d is past the end of the %d-byte directory", ErrCorruptDirectory, i, e.DirDataOffset, size)
+		}
+	}
+	return nil
+}
+
+// readDirectory reads the entries of the directory at offset along with
+// their names. The entry array is read with a single read, and names that
+// follow each other in the directory are read without seeking between them,
+// which keeps very wide directories cheap to list.
+func readDirectory(dir io.ReadSeeker, offset int) ([]Entry, []string, error) {
+	var (
+		numEntries  uint32
+		entryOffset uint32
 	)
-	out, err := os.Create(name)
+	const entrySize = 9
+	if _, err := dir.Seek(int64(offset), io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	if err := binary.Read(dir, binary.LittleEndian, &numEntries); err != nil {
+		return nil, nil, err
+	}
+	if err := binary.Read(dir, binary.LittleEndian, &entryOffset); err != nil {
+		return nil, nil, err
+	}
+	if numEntries == 0 {
+		return nil, nil, nil
+	}
+	size, err := dir.Seek(0, io.SeekEnd)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if err := checkEntryTable(int64(numEntries), int64(entryOffset), size); err != nil {
+		return nil, nil, err
+	}
+	if _, err := dir.Seek(int64(entryOffset), io.SeekStart); err != nil {
+		return nil, nil, err
 	}
+	entries := make([]Entry, numEntries)
+	if err := binary.Read(dir, binary.LittleEndian, entries); err != nil {
+		return nil, nil, err
+	}
+	if err := checkEntries(entries, size); err != nil {
+		return nil, nil, err
+	}
+	// The bufio.Reader reads ahead of the names it returns, so the position
+	// of dir says nothing about where the next name starts. pos tracks that
+	// instead, and the reader is only reset when a name is elsewhere.
+	var (
+		names = make([]string, numEntries)
+		pos   = int64(-1)
+		br    = bufio.NewReader(dir)
+	)
+	for i, entry := range entries {
+		if int64(entry.NameOffset) != pos {
+			if _, err := dir.Seek(int64(entry.NameOffset), io.SeekStart); err != nil {
+				return nil, nil, err
+			}
+			br.Reset(dir)
+			pos = int64(entry.NameOffset)
+		}
+		fileName, err := br.ReadBytes(0)
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("%w: name at offset %d has no terminator", ErrCorruptDirectory, entry.NameOffset)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		pos += int64(len(fileName))
+		names[i] = string(fileName[:len(fileName)-1])
+	}
+	return entries, names, nil
+}
+
+// ExtractFile decrypts and decompresses the file whose FileData is at
+// offset and returns its contents. The FileData is read from the archive
+// itself, so unlike ProcessFile it needs no decrypted directory and writes
+// nothing to disk.
+func ExtractFile(archive io.ReadSeeker, key byte, offset int) ([]byte, error) {
+	a := fileArchive(archive, key)
+	buf, err := ReadAndDecryptAt(a.ra, key, binary.Size(FileData{}), offset)
+	if err != nil {
+		return nil, err
+	}
+	var header FileData
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	return a.ReadFileAt(header)
+}
+
+// ProcessFile decrypts and decompresses a file in the archive. If that
+// fails part way, the partly written file is removed.
+func ProcessFile(archive, dir io.ReadSeeker, key byte, name string, offset int) error {
+	return ProcessFileContext(context.Background(), archive, dir, key, name, offset)
+}
+
+// ProcessFileContext is ProcessFile that stops with ctx.Err() once ctx is
+// done. It checks ctx before each chunk and removes the partly written file
+// when cancelled.
+func ProcessFileContext(ctx context.Context, archive, dir io.ReadSeeker, key byte, name string, offset int) error {
+	return ProcessFileOptions(ctx, archive, dir, key, name, offset, ExtractOptions{})
+}
+
+// ProcessFileOptions is ProcessFileContext that extracts the file with
+// opts, such as to report progress through opts.Progress. Options that only
+// apply to whole archives, such as Rename, are ignored.
+func ProcessFileOptions(ctx context.Context, archive, dir io.ReadSeeker, key byte, name string, offset int, opts ExtractOptions) error {
+	var header FileData
 	if _, err := dir.Seek(int64(offset), io.SeekStart); err != nil {
 		return err
 	}
 	if err := binary.Read(dir, binary.LittleEndian, &header); err != nil {
 		return err
 	}
-	numChunks = int(header.FileSize) / maxChunkSize
-	if int(header.FileSize)%maxChunkSize != 0 {
-		numChunks++
+	a := fileArchive(archive, key)
+	a.Options = opts
+	return a.extractFileTo(ctx, name, archiveFile{name: name, fd: header, offset: offset})
+}
+
+// ExtractParallel is TraverseTree that extracts up to workers files at once,
+// or runtime.NumCPU() if workers is less than one. The whole tree is walked
+// first, then the files are decoded by workers that each read the archive
+// through ReadAt, so archive must support concurrent ReadAt calls, as
+// *os.File does. The first file to fail cancels the files still to come,
+// and its error is returned.
+func ExtractParallel(ctx context.Context, archive io.ReaderAt, dir io.ReadSeeker, key byte, parent string, offset, workers int) error {
+	if workers < 1 {
+		workers = runtime.NumCPU()
 	}
-	sizes = make([]uint32, numChunks)
-	if _, err := archive.Seek(int64(header.DataOffset), io.SeekStart); err != nil {
+	a := &Archive{ra: archive, key: key, chunkSize: MaxChunkSize}
+	var (
+		files []archiveFile
+		names []string
+	)
+	err := walkTree(dir, "", offset, func(name string, fd FileData) error {
+		out, _, err := a.outputPath(parent, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, archiveFile{name: name, fd: fd})
+		names = append(names, out)
+		return nil
+	}, seenDirs{})
+	if err != nil {
 		return err
 	}
-	fileData, err := ReadAndDecrypt(archive, key, longLength*numChunks, int(header.DataOffset))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu    sync.Mutex
+		first error
+	)
+	parallel(len(files), workers, func(i int) {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := a.extractFileTo(ctx, names[i], files[i]); err != nil {
+			mu.Lock()
+			if first == nil && ctx.Err() == nil {
+				first = err
+			}
+			mu.Unlock()
+			cancel()
+		}
+	})
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
+
+// decoder reads files out of an archive.
+type decoder struct {
+	archive       io.ReaderAt
+	key           byte
+	chunkSize     int      // Decompressed size of every chunk but the last.
+	verify        bool     // Check each chunk's checksum before decoding it.
+	timings       *Timings // Where to record time spent, if not nil.
+	recoverChunks bool     // Try every method on chunks that fail to decode.
+
+	// ctx, if not nil, is checked before each chunk so that decoding a
+	// large file can be cancelled.
+	ctx context.Context
+}
+
+// read reads and decrypts size bytes at offset in the archive.
+func (d decoder) read(size, offset int) ([]byte, error) {
+	start := time.Now()
+	buf, err := readAt(d.archive, size, offset)
+	d.timings.addRead(start)
+	if err != nil {
+		return nil, err
+	}
+	start = time.Now()
+	DecryptInPlace(buf, d.key, offset)
+	d.timings.addDecrypt(start)
+	return buf, nil
+}
+
+// readInto is read with *buf, grown if need be, holding the data. The
+// result is only valid until buf is next used.
+func (d decoder) readInto(buf *[]byte, size, offset int) ([]byte, error) {
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	data := (*buf)[:size]
+	start := time.Now()
+	err := readFull(d.archive, data, offset)
+	d.timings.addRead(start)
+	if err != nil {
+		return nil, err
+	}
+	start = time.Now()
+	DecryptInPlace(data, d.key, offset)
+	d.timings.addDecrypt(start)
+	return data, nil
+}
+
+// fileBuffers holds buffers for the stored data of a file, which decodeChunks
+// reuses from file to file so that bulk extraction does not allocate one per
+// file.
+var fileBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// maxPooledBuffer is the largest buffer putFileBuffer keeps, so that one
+// large file does not leave its stored data pinned in the pool.
+const maxPooledBuffer = 4 * MaxChunkSize
+
+// putFileBuffer returns buf to fileBuffers unless it has grown past
+// maxPooledBuffer, in which case it is left for the garbage collector.
+func putFileBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBuffer {
+		return
+	}
+	fileBuffers.Put(buf)
+}
+
+// chunkCount returns how many chunks hold a file of the given size.
+func chunkCount(fileSize uint32, chunkSize int) int {
+	n := int(fileSize) / chunkSize
+	if int(fileSize)%chunkSize != 0 {
+		n++
+	}
+	return n
+}
+
+// decodeFile decrypts and decompresses the chunks of a file into out.
+func (d decoder) decodeFile(header FileData, out io.Writer) error {
+	return d.decodeChunks(header, out, -1)
+}
+
+// decodeChunks is decodeFile limited to the first limit chunks of the file.
+// A negative limit decodes every chunk.
+func (d decoder) decodeChunks(header FileData, out io.Writer, limit int) error {
+	if d.timings != nil {
+		out = &timedWriter{w: out, t: d.timings}
+	}
+	var (
+		chunk     Chunk
+		numChunks int
+		sizes     []uint32
+		chunkSum  int
+		total     int // Bytes written to out.
+	)
+	buf := fileBuffers.Get().(*[]byte)
+	defer putFileBuffer(buf)
+	numChunks = chunkCount(header.FileSize, d.chunkSize)
+	sizes = make([]uint32, numChunks)
+	fileData, err := d.readInto(buf, ChunkTableEntrySize*numChunks, int(header.DataOffset))
+	if err != nil {
+		return fmt.Errorf("chunk size table: %w", err)
+	}
 	fileReader := bytes.NewReader(fileData)
 	for i := range sizes {
 		var chunkSize uint32
@@ -178,100 +980,608 @@ func ProcessFile(archive, dir io.ReadSeeker, key byte, name string, offset int)
 			return err
 		}
 		sizes[i] = chunkSize
+	}
+	if limit >= 0 && limit < len(sizes) {
+		sizes = sizes[:limit]
+	}
+	if err := d.checkChunkSizes(int(header.DataOffset)+ChunkTableEntrySize*numChunks, sizes); err != nil {
+		return err
+	}
+	for _, chunkSize := range sizes {
 		chunkSum += int(chunkSize)
 	}
-	fileData, err = ReadAndDecrypt(archive, key, chunkSum, int(header.DataOffset)+longLength*numChunks)
+	fileData, err = d.readInto(buf, chunkSum, int(header.DataOffset)+ChunkTableEntrySize*numChunks)
 	if err != nil {
 		return err
 	}
 	fileReader = bytes.NewReader(fileData)
-	for range sizes {
+	for i := range sizes {
+		if d.ctx != nil {
+			if err := d.ctx.Err(); err != nil {
+				return err
+			}
+		}
 		if err := binary.Read(fileReader, binary.LittleEndian, &chunk.ChunkHeader); err != nil {
 			return err
 		}
-		chunk.Data = make([]byte, int(chunk.ChunkHeader.CompressedSize))
-		n, err := fileReader.Read(chunk.Data)
-		if err != nil {
-			return err
+		if err := checkDecompressedSize(chunk.ChunkHeader, d.chunkSize); err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+		// The chunk is decrypted in place, in the buffer it was read into.
+		pos, n := len(fileData)-fileReader.Len(), int(chunk.ChunkHeader.CompressedSize)
+		if n > fileReader.Len() {
+			return fmt.Errorf("chunk %d: %w: %d of %d bytes", i, ErrShortRead, fileReader.Len(), n)
 		}
-		if n != len(chunk.Data) {
-			return fmt.Errorf("short read")
+		chunk.Data = fileData[pos : pos+n]
+		fileReader.Seek(int64(n), io.SeekCurrent)
+		if d.verify && !d.recoverChunks {
+			if sum := chunk.Checksum(); sum != chunk.ChunkHeader.Checksum {
+				return fmt.Errorf("chunk %d: %w: %x, wanted %x", i, ErrChecksumMismatch, sum, chunk.ChunkHeader.Checksum)
+			}
 		}
+		start := time.Now()
 		if chunk.ChunkHeader.Encrypted != 0 {
 			chunk.Decrypt()
 		}
-		switch chunk.CompressionMethod {
-		case 0:
-			io.Copy(out, bytes.NewReader(chunk.Data))
-		case 1:
-			chunk.Data = Decompress(chunk.Data)
-			io.Copy(out, bytes.NewReader(chunk.Data))
-		case 2:
-			zbuf, err := zlib.NewReader(bytes.NewReader(chunk.Data))
+		d.timings.addDecrypt(start)
+		start, written := time.Now(), d.timings.written()
+		if d.recoverChunks {
+			data, err := recoverChunk(chunk)
 			if err != nil {
+				return fmt.Errorf("chunk %d: %w", i, err)
+			}
+			if _, err := out.Write(data); err != nil {
 				return err
 			}
-			io.Copy(out, zbuf)
-		default:
-			return fmt.Errorf("unknown compression method: %x", chunk.CompressionMethod)
+			total += len(data)
+			d.timings.addDecompress(chunk.CompressionMethod, start, written)
+			continue
 		}
+		data, err := decodeMethod(chunk.CompressionMethod, chunk.Data, int(chunk.DecompressedSize))
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+		total += len(data)
+		d.timings.addDecompress(chunk.CompressionMethod, start, written)
+	}
+	if limit < 0 && total != int(header.FileSize) {
+		return fmt.Errorf("decoded %d bytes, wanted %d", total, header.FileSize)
 	}
-	out.Close()
 	return nil
 }
+
+// recoverChunk decodes a decrypted chunk whose header may be damaged. The
+// declared compression method is tried first and then each of the others;
+// the first to produce exactly DecompressedSize bytes without error wins.
+func recoverChunk(chunk Chunk) ([]byte, error) {
+	methods := []byte{chunk.CompressionMethod}
+	for m := byte(0); m <= 2; m++ {
+		if m != chunk.CompressionMethod {
+			methods = append(methods, m)
+		}
+	}
+	for _, m := range methods {
+		data, err := decodeMethod(m, chunk.Data, int(chunk.DecompressedSize))
+		if err == nil && len(data) == int(chunk.DecompressedSize) {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("no compression method decodes the chunk")
+}
+
+// inflate decompresses a zlib stream that should hold exactly size bytes,
+// failing if the stream is shorter or longer than that. As with Decompress,
+// the output grows as it is decoded, so a size taken from a damaged header
+// costs no more than the stream inflates to.
+func inflate(data []byte, size int) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if size <= MaxChunkSize {
+		buf.Grow(size)
+	}
+	n, err := io.Copy(&buf, io.LimitReader(zr, int64(size)))
+	if err == nil && n < int64(size) {
+		err = io.ErrUnexpectedEOF
+	}
+	if errors.Is(err, zlib.ErrChecksum) {
+		return nil, fmt.Errorf("zlib stream of %d bytes: %w", n, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("zlib stream ended after %d of %d bytes: %w", n, size, err)
+	}
+	// A stream that fills size exactly has its end, and the checksum after
+	// it, read only here.
+	switch n, err := zr.Read(make([]byte, 1)); {
+	case n > 0:
+		return nil, fmt.Errorf("zlib stream is longer than %d bytes", size)
+	case errors.Is(err, zlib.ErrChecksum):
+		return nil, fmt.Errorf("zlib stream of %d bytes: %w", size, err)
+	case err == nil:
+		return nil, fmt.Errorf("zlib stream does not end after %d bytes", size)
+	case err != io.EOF:
+		return nil, fmt.Errorf("zlib stream after %d bytes: %w", size, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeMethod decodes chunk data stored with method into memory. method is
+// the chunk's CompressionMethod; FileData.Flag is never consulted.
+func decodeMethod(method byte, data []byte, size int) ([]byte, error) {
+	switch method {
+	case 0:
+		return data, nil
+	case 1:
+		return Decompress(data, size)
+	case 2:
+		return inflate(data, size)
+	}
+	dcomp := decompressor(method)
+	if dcomp == nil {
+		return nil, &UnknownCompressionError{Method: method}
+	}
+	return dcomp(data, size)
+}
+
+// chunkHeaders reads the header of each of a file's chunks without reading
+// the chunk data.
+func (d decoder) chunkHeaders(header FileData) ([]ChunkHeader, error) {
+	sizes, err := d.chunkSizes(header)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		headers = make([]ChunkHeader, len(sizes))
+		offset  = int(header.DataOffset) + ChunkTableEntrySize*len(sizes)
+		size    = binary.Size(ChunkHeader{})
+	)
+	for i := range headers {
+		buf, err := d.read(size, offset)
+		if err != nil {
+			return nil, err
+		}
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &headers[i]); err != nil {
+			return nil, err
+		}
+		offset += int(sizes[i])
+	}
+	return headers, nil
+}
+
+// chunks reads the chunks of the file described by header as they are
+// stored, without decrypting or decompressing them.
+func (d decoder) chunks(header FileData) ([]Chunk, error) {
+	sizes, err := d.chunkSizes(header)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		chunks     = make([]Chunk, len(sizes))
+		offset     = int(header.DataOffset) + ChunkTableEntrySize*len(sizes)
+		headerSize = binary.Size(ChunkHeader{})
+	)
+	for i := range chunks {
+		if int(sizes[i]) < headerSize {
+			return nil, fmt.Errorf("chunk %d: size %d is smaller than its header", i, sizes[i])
+		}
+		buf, err := d.read(int(sizes[i]), offset)
+		if err != nil {
+			return nil, err
+		}
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &chunks[i].ChunkHeader); err != nil {
+			return nil, err
+		}
+		chunks[i].Data = buf[headerSize:]
+		offset += int(sizes[i])
+	}
+	return chunks, nil
+}
+
+// chunkSizes reads the table of stored chunk sizes, headers included, that
+// precedes a file's chunks.
+func (d decoder) chunkSizes(header FileData) ([]uint32, error) {
+	numChunks := chunkCount(header.FileSize, d.chunkSize)
+	table, err := d.read(ChunkTableEntrySize*numChunks, int(header.DataOffset))
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]uint32, numChunks)
+	for i := range sizes {
+		sizes[i] = binary.LittleEndian.Uint32(table[i*ChunkTableEntrySize:])
+	}
+	if err := d.checkChunkSizes(int(header.DataOffset)+len(table), sizes); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// checkChunkSizes checks the stored sizes of chunks that start at offset in
+// the archive before anything is allocated for them. Each chunk must hold
+// at least its header and at most twice chunkSize, which is more than any
+// compression method expands a chunk by, and, when the size of the archive
+// can be told, all of them must end within it. Without this a damaged table
+// could make decoding allocate gigabytes for a file of a few bytes.
+func (d decoder) checkChunkSizes(offset int, sizes []uint32) error {
+	var (
+		headerSize = int64(binary.Size(ChunkHeader{}))
+		end        = int64(offset)
+	)
+	for i, size := range sizes {
+		if int64(size) < headerSize || int64(size) > headerSize+2*int64(d.chunkSize) {
+			return fmt.Errorf("chunk %d: stored size %d is out of range", i, size)
+		}
+		end += int64(size)
+	}
+	if size, ok := archiveSize(d.archive); ok && end > size {
+		return fmt.Errorf("%w: chunks end at %d, past the end of the %d-byte archive", ErrShortRead, end, size)
+	}
+	return nil
+}
+
+// checkDecompressedSize checks that the chunk with header h decompresses to
+// no more than chunkSize bytes, the most any chunk of a file holds, before
+// anything is decoded or allocated for it.
+func checkDecompressedSize(h ChunkHeader, chunkSize int) error {
+	if int64(h.DecompressedSize) > int64(chunkSize) {
+		return fmt.Errorf("decompressed size %d is larger than a chunk of %d bytes", h.DecompressedSize, chunkSize)
+	}
+	return nil
+}
+
+// archiveSize returns the size of r if it can be told without reading it.
+func archiveSize(r io.ReaderAt) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), true
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := r.Stat()
+		if err != nil {
+			return 0, false
+		}
+		return info.Size(), true
+	case *seekerAt:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		size, err := r.r.Seek(0, io.SeekEnd)
+		return size, err == nil
+	}
+	return 0, false
+}
+
+// rawFile returns a file's chunk size table and chunks exactly as stored,
+// with only the archive-level encryption removed.
+func (d decoder) rawFile(header FileData) ([]byte, error) {
+	sizes, err := d.chunkSizes(header)
+	if err != nil {
+		return nil, err
+	}
+	size := ChunkTableEntrySize * len(sizes)
+	for _, chunkSize := range sizes {
+		size += int(chunkSize)
+	}
+	return d.read(size, int(header.DataOffset))
+}
+
+// Checksum sums the chunk's data as it is stored, before Decrypt is applied.
+func (c *Chunk) Checksum() uint32 {
+	var sum uint32
+	for _, b := range c.Data {
+		sum += uint32(b)
+	}
+	return sum
+}
+
+// Decrypt undoes the chunk-level encryption of the data, which is used when
+// Encrypted is not 0. It is separate from the archive key: archives with a
+// key of 0 may still encrypt their chunks, as TADEMO.ufo does.
 func (c *Chunk) Decrypt() {
 	for i := range c.Data {
 		c.Data[i] = (c.Data[i] - byte(i)) ^ byte(i)
 	}
 }
-func Decompress(input []byte) []byte {
+
+// windows holds LZ77 windows for Decompress to reuse.
+var windows = sync.Pool{New: func() any { return new([WindowSize]byte) }}
+
+// Decompress decodes LZ77 chunk data that decompresses to size bytes, as
+// given by ChunkHeader.DecompressedSize. The stream normally ends with a
+// back-reference to offset 0, but input may also simply run out once size
+// bytes are decoded, leaving the rest of the last tag byte unused. It
+// returns an error if input runs out before then, or if the terminator
+// comes at any other length, or if a back-reference reads part of the
+// window that nothing has been written to. Decoding stops as soon as size
+// is exceeded, so a damaged stream cannot use more memory than that, and
+// the output grows as it is decoded rather than being sized from size up
+// front, so a size taken from a damaged header costs no more than the
+// stream decodes to.
+func Decompress(input []byte, size int) ([]byte, error) {
+	// Slots of a pooled window still hold bytes from the last stream, but
+	// none are read before being written; see the check below.
+	window := windows.Get().(*[WindowSize]byte)
+	defer windows.Put(window)
 	var (
-		window       [4096]byte
-		windowPos    = 1
-		writeBuf     bytes.Buffer
-		decompressed []byte
+		windowPos = 1
+		writeBuf  bytes.Buffer
 	)
+	if size <= MaxChunkSize {
+		writeBuf.Grow(size)
+	}
 	reader := bytes.NewReader(input)
 	for {
 		tag, err := reader.ReadByte()
 		if err != nil {
-			return nil
+			if writeBuf.Len() == size {
+				return writeBuf.Bytes(), nil
+			}
+			return nil, fmt.Errorf("lz77: input ended at offset %d after %d of %d bytes", len(input), writeBuf.Len(), size)
 		}
 		for i := 0; i < 8; i++ {
 			if (tag & 1) == 0 {
 				value, err := reader.ReadByte()
 				if err != nil {
-					return nil
-				}
-				err = writeBuf.WriteByte(value)
-				if err != nil {
-					return nil
+					if writeBuf.Len() == size {
+						return writeBuf.Bytes(), nil
+					}
+					return nil, fmt.Errorf("lz77: input ended at offset %d before a literal", len(input))
 				}
+				writeBuf.WriteByte(value)
 				window[windowPos] = value
-				windowPos = (windowPos + 1) & 0x0fff
+				windowPos = (windowPos + 1) & (WindowSize - 1)
 			} else {
 				var packedData uint16
-				err = binary.Read(reader, binary.LittleEndian, &packedData)
-				if err != nil {
-					return nil
+				offset := len(input) - reader.Len()
+				if err := binary.Read(reader, binary.LittleEndian, &packedData); err != nil {
+					if writeBuf.Len() == size {
+						return writeBuf.Bytes(), nil
+					}
+					return nil, fmt.Errorf("lz77: input ended at offset %d inside a back-reference", offset)
 				}
 				windowReadPos := packedData >> 4
 				if windowReadPos == 0 {
-					decompressed = writeBuf.Bytes()
-					return decompressed
+					if writeBuf.Len() != size {
+						return nil, fmt.Errorf("lz77: decompressed to %d bytes, wanted %d", writeBuf.Len(), size)
+					}
+					return writeBuf.Bytes(), nil
 				}
 				count := (packedData & 0x0f) + 2
 				for x := 0; x < int(count); x++ {
-					err = writeBuf.WriteByte(window[windowReadPos])
-					if err != nil {
-						return nil
+					// Slot p of the window is first written by byte p-1
+					// of the output, and slot 0 by byte 4095.
+					if written := writeBuf.Len(); written < WindowSize && (windowReadPos == 0 || int(windowReadPos) > written) {
+						return nil, fmt.Errorf("lz77: back-reference at input offset %d reads window position %d before it is written", offset, windowReadPos)
 					}
+					writeBuf.WriteByte(window[windowReadPos])
 					window[windowPos] = window[windowReadPos]
-					windowReadPos = (windowReadPos + 1) & 0x0fff
-					windowPos = (windowPos + 1) & 0x0fff
+					windowReadPos = (windowReadPos + 1) & (WindowSize - 1)
+					windowPos = (windowPos + 1) & (WindowSize - 1)
 				}
 			}
+			if writeBuf.Len() > size {
+				return nil, fmt.Errorf("lz77: decompressed past %d bytes at input offset %d", size, len(input)-reader.Len())
+			}
 			tag = tag >> 1
 		}
 	}
 }
+
+// NewDecompressor returns a reader of the LZ77 chunk data read from r that
+// decodes it a token at a time as it is read, keeping only the window
+// between calls rather than the whole decompressed chunk. It accepts and
+// rejects the same streams as Decompress and reports the same errors from
+// Read, but as it goes, so bytes decoded before an error has been found
+// are returned first. Read returns io.EOF once the stream ends at size
+// bytes. Unless r is an io.ByteReader it is read through a bufio.Reader,
+// which may read past the end of the stream. OpenFile reads LZ77 chunks
+// through it.
+func NewDecompressor(r io.Reader, size int) io.Reader {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &lz77Reader{r: br, size: size, windowPos: 1}
+}
+
+// lz77Reader is the reader returned by NewDecompressor.
+type lz77Reader struct {
+	r         io.ByteReader
+	size      int
+	written   int // Bytes returned so far.
+	offset    int // Bytes read from r so far, for errors.
+	window    [WindowSize]byte
+	windowPos int
+	tag       byte
+	tokens    int    // Tokens left in tag.
+	literal   bool   // Whether the current token is a literal.
+	value     byte   // The current token's byte, if it is a literal.
+	readPos   uint16 // Window position the current back-reference reads.
+	count     int    // Bytes of the current token not yet returned.
+	err       error
+}
+
+func (d *lz77Reader) Read(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		if d.count == 0 {
+			if d.err != nil {
+				return n, d.err
+			}
+			d.err = d.next()
+			continue
+		}
+		if d.written == d.size {
+			d.err, d.count = fmt.Errorf("lz77: decompressed past %d bytes at input offset %d", d.size, d.offset), 0
+			return n, d.err
+		}
+		value := d.value
+		if !d.literal {
+			// As in Decompress, slot p of the window is first written by
+			// byte p-1 of the output, and slot 0 by byte 4095.
+			if d.written < WindowSize && (d.readPos == 0 || int(d.readPos) > d.written) {
+				d.err, d.count = fmt.Errorf("lz77: back-reference at input offset %d reads window position %d before it is written", d.offset-2, d.readPos), 0
+				return n, d.err
+			}
+			value = d.window[d.readPos]
+			d.readPos = (d.readPos + 1) & (WindowSize - 1)
+		}
+		d.window[d.windowPos] = value
+		d.windowPos = (d.windowPos + 1) & (WindowSize - 1)
+		p[n] = value
+		n++
+		d.written++
+		d.count--
+	}
+	return n, nil
+}
+
+// next reads the next token, returning io.EOF where the stream may end.
+func (d *lz77Reader) next() error {
+	if d.tokens == 0 {
+		tag, err := d.readByte()
+		if err != nil {
+			return d.end(err, fmt.Errorf("lz77: input ended at offset %d after %d of %d bytes", d.offset, d.written, d.size))
+		}
+		d.tag, d.tokens = tag, 8
+	}
+	literal := d.tag&1 == 0
+	d.tag >>= 1
+	d.tokens--
+	if literal {
+		value, err := d.readByte()
+		if err != nil {
+			return d.end(err, fmt.Errorf("lz77: input ended at offset %d before a literal", d.offset))
+		}
+		d.literal, d.value, d.count = true, value, 1
+		return nil
+	}
+	offset := d.offset
+	lo, err := d.readByte()
+	if err == nil {
+		var hi byte
+		hi, err = d.readByte()
+		d.readPos = uint16(lo) | uint16(hi)<<8
+	}
+	if err != nil {
+		return d.end(err, fmt.Errorf("lz77: input ended at offset %d inside a back-reference", offset))
+	}
+	packedData := d.readPos
+	if d.readPos = packedData >> 4; d.readPos == 0 {
+		if d.written != d.size {
+			return fmt.Errorf("lz77: decompressed to %d bytes, wanted %d", d.written, d.size)
+		}
+		return io.EOF
+	}
+	d.literal, d.count = false, int(packedData&0x0f)+2
+	return nil
+}
+
+// readByte reads a byte of input, counting it.
+func (d *lz77Reader) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == nil {
+		d.offset++
+	}
+	return b, err
+}
+
+// end returns the error for input that ended with err: io.EOF if size bytes
+// have been decoded, short if fewer have, or err itself if reading failed.
+func (d *lz77Reader) end(err, short error) error {
+	if err != io.EOF {
+		return err
+	}
+	if d.written == d.size {
+		return io.EOF
+	}
+	return short
+}
+
+// Compress encodes input as LZ77 chunk data that Decompress decodes back to
+// input. Each tag byte is followed by eight tokens, its bits taken from the
+// lowest up: a clear bit is a literal byte and a set bit a little-endian
+// uint16 holding a position in the 4096-byte window in its upper 12 bits
+// and the length of the match minus 2 in its lower 4. Matches are found
+// through hash chains of two-byte prefixes, and a back-reference to
+// position 0 ends the stream.
+func Compress(input []byte) []byte {
+	const (
+		minMatch = 2
+		maxMatch = 0x0f + minMatch
+		maxChain = 256
+	)
+	var (
+		out    bytes.Buffer
+		tagPos int
+		tagBit = 8
+		head   [1 << 16]int32
+		prev   = make([]int32, len(input))
+	)
+	for i := range head {
+		head[i] = -1
+	}
+	token := func(ref bool) {
+		if tagBit == 8 {
+			tagPos = out.Len()
+			out.WriteByte(0)
+			tagBit = 0
+		}
+		if ref {
+			out.Bytes()[tagPos] |= 1 << tagBit
+		}
+		tagBit++
+	}
+	insert := func(p int) {
+		if p+1 < len(input) {
+			h := int(input[p])<<8 | int(input[p+1])
+			prev[p] = head[h]
+			head[h] = int32(p)
+		}
+	}
+	for i := 0; i < len(input); {
+		var bestPos, bestLen int
+		if i+1 < len(input) {
+			limit := len(input) - i
+			if limit > maxMatch {
+				limit = maxMatch
+			}
+			h := int(input[i])<<8 | int(input[i+1])
+			for cand, n := int(head[h]), 0; cand >= 0 && i-cand < WindowSize && n < maxChain; cand, n = int(prev[cand]), n+1 {
+				// Byte j sits at window position j+1, and position 0
+				// cannot be referenced since it ends the stream.
+				if (cand+1)%WindowSize == 0 {
+					continue
+				}
+				l := 0
+				for l < limit && input[cand+l] == input[i+l] {
+					l++
+				}
+				if l > bestLen {
+					bestPos, bestLen = cand, l
+					if l == limit {
+						break
+					}
+				}
+			}
+		}
+		if bestLen < minMatch {
+			token(false)
+			out.WriteByte(input[i])
+			insert(i)
+			i++
+			continue
+		}
+		token(true)
+		binary.Write(&out, binary.LittleEndian, uint16((bestPos+1)%WindowSize<<4|(bestLen-minMatch)))
+		for k := 0; k < bestLen; k++ {
+			insert(i + k)
+		}
+		i += bestLen
+	}
+	token(true)
+	out.Write([]byte{0, 0})
+	return out.Bytes()
+}
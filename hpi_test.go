@@ -2,9 +2,19 @@ package hpi
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -23,6 +33,51 @@ func TestScanHeader(t *testing.T) {
 		t.Errorf("Got %x, wanted %x", header.Marker, HPIMagic)
 	}
 }
+func TestExtractTADEMO(t *testing.T) {
+	file, err := os.Open("TADEMO.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header, key, dir, err := LoadDirectory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Key != 0 || key != 0 {
+		t.Fatalf("Got key %d, wanted %d", key, 0)
+	}
+	dest := t.TempDir()
+	if err := TraverseTree(file, dir, key, dest, int(header.Start)); err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string]int64{
+		"anims/zzz_gadget.gaf":          12440,
+		"features/corpses/zzz_dead.tdf": 605,
+		"objects3d/zzz_dead.3do":        2710,
+		"objects3d/zzz.3do":             7178,
+		"scripts/zzz.cob":               2221,
+		"scripts/zzz.bos":               3540,
+		"unitpicE/zzz.pcx":              10304,
+		"unitsE/zzz.fbi":                1042,
+	}
+	for name, size := range sizes {
+		info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if info.Size() != size {
+			t.Errorf("%s: Got %d, wanted %d", name, info.Size(), size)
+		}
+	}
+	fbi, err := os.ReadFile(filepath.Join(dest, "unitsE", "zzz.fbi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(fbi, []byte("//kungligt gjort av kung fnord")) || !bytes.Contains(fbi, []byte("\tUnitName=ZZZ;")) {
+		t.Errorf("Got %q, wanted the ZZZ unit", fbi[:80])
+	}
+}
 func TestXORDecrypt(t *testing.T) {
 	var headerKey uint32 = 0x0000007D
 	var expected uint32 = 0xFFFFFE0A
@@ -30,6 +85,24 @@ func TestXORDecrypt(t *testing.T) {
 		t.Errorf("Got %x, wanted %x", value, expected)
 	}
 }
+func TestKeyToHeaderField(t *testing.T) {
+	for k := 0; k < 256; k++ {
+		field := KeyToHeaderField(byte(k))
+		if field > 0xff {
+			t.Errorf("%d: Got field %x, wanted one below 0x100", k, field)
+		}
+		if got := (Header{Key: field}).GetKey(); got != byte(k) {
+			t.Errorf("Got %d, wanted %d", got, k)
+		}
+	}
+	if got := KeyToHeaderField(190); got != 0xaf {
+		t.Errorf("Got %x, wanted %x", got, 0xaf)
+	}
+	// Fields of 0x100 and above are not what KeyToHeaderField returns.
+	if got := (Header{Key: 0x1af}).GetKey(); got != 0xbe {
+		t.Errorf("Got %x, wanted %x", got, 0xbe)
+	}
+}
 func TestReadAndDecrypt(t *testing.T) {
 	var header Header
 	file, err := os.Open("Example.ufo")
@@ -77,3 +150,1463 @@ func TestTraverse(t *testing.T) {
 	}
 	os.RemoveAll(dir)
 }
+
+// wideDirectory builds a directory with n file entries. When reversed is
+// set the names are stored in the opposite order to the entries.
+func wideDirectory(n int, reversed bool) []byte {
+	var names bytes.Buffer
+	offsets := make([]uint32, n)
+	nameStart := 8 + 9*n
+	for i := 0; i < n; i++ {
+		j := i
+		if reversed {
+			j = n - 1 - i
+		}
+		offsets[j] = uint32(nameStart + names.Len())
+		fmt.Fprintf(&names, "file%05d.gaf\x00", j)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(n))
+	binary.Write(&buf, binary.LittleEndian, uint32(8))
+	for i := 0; i < n; i++ {
+		binary.Write(&buf, binary.LittleEndian, Entry{NameOffset: offsets[i]})
+	}
+	buf.Write(names.Bytes())
+	return buf.Bytes()
+}
+func TestReadDirectoryWide(t *testing.T) {
+	for _, reversed := range []bool{false, true} {
+		entries, names, err := readDirectory(bytes.NewReader(wideDirectory(5000, reversed)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 5000 || len(names) != 5000 {
+			t.Fatalf("Got %d entries, wanted %d", len(entries), 5000)
+		}
+		for _, i := range []int{0, 1, 4321, 4999} {
+			if want := fmt.Sprintf("file%05d.gaf", i); names[i] != want {
+				t.Errorf("Got %s, wanted %s", names[i], want)
+			}
+		}
+	}
+}
+func TestReadDirectoryTruncated(t *testing.T) {
+	buf := wideDirectory(10, false)
+	if _, _, err := readDirectory(bytes.NewReader(buf[:50]), 0); err == nil {
+		t.Error("expected an error for a truncated entry array")
+	}
+	if _, _, err := sliceDirectory(buf[:50], 0); err == nil {
+		t.Error("expected an error for a truncated entry array")
+	}
+	if _, _, err := sliceDirectory(buf[:len(buf)-1], 0); err == nil {
+		t.Error("expected an error for an unterminated name")
+	}
+}
+func TestSliceDirectory(t *testing.T) {
+	for _, reversed := range []bool{false, true} {
+		buf := wideDirectory(5000, reversed)
+		wantEntries, wantNames, err := readDirectory(bytes.NewReader(buf), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, names, err := sliceDirectory(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(wantEntries) {
+			t.Fatalf("Got %d entries, wanted %d", len(entries), len(wantEntries))
+		}
+		for i := range entries {
+			if entries[i] != wantEntries[i] || names[i] != wantNames[i] {
+				t.Fatalf("entry %d: Got %v %s, wanted %v %s", i, entries[i], names[i], wantEntries[i], wantNames[i])
+			}
+		}
+	}
+}
+func BenchmarkReadDirectoryWide(b *testing.B) {
+	dir := bytes.NewReader(wideDirectory(10000, false))
+	for i := 0; i < b.N; i++ {
+		if _, _, err := readDirectory(dir, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+func BenchmarkSliceDirectoryWide(b *testing.B) {
+	dir := wideDirectory(10000, false)
+	for i := 0; i < b.N; i++ {
+		if _, _, err := sliceDirectory(dir, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// storedFile lays out data as a chunk size table followed by uncompressed,
+// unencrypted chunks of at most chunkSize bytes.
+func storedFile(data []byte, chunkSize int) []byte {
+	var table, chunks bytes.Buffer
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		chunk := Chunk{
+			ChunkHeader: ChunkHeader{
+				Marker:           ChunkStart,
+				CompressedSize:   uint32(n),
+				DecompressedSize: uint32(n),
+			},
+			Data: data[:n],
+		}
+		chunk.ChunkHeader.Checksum = chunk.Checksum()
+		binary.Write(&table, binary.LittleEndian, uint32(binary.Size(chunk.ChunkHeader)+n))
+		binary.Write(&chunks, binary.LittleEndian, chunk.ChunkHeader)
+		chunks.Write(chunk.Data)
+		data = data[n:]
+	}
+	return append(table.Bytes(), chunks.Bytes()...)
+}
+func TestChunkCount(t *testing.T) {
+	tests := []struct {
+		size      uint32
+		chunkSize int
+		want      int
+	}{
+		{0, MaxChunkSize, 0},
+		{1, MaxChunkSize, 1},
+		{MaxChunkSize, MaxChunkSize, 1},
+		{MaxChunkSize + 1, MaxChunkSize, 2},
+		{263256, MaxChunkSize, 5},
+		{40, 16, 3},
+	}
+	for _, test := range tests {
+		if got := chunkCount(test.size, test.chunkSize); got != test.want {
+			t.Errorf("chunkCount(%d, %d): Got %d, wanted %d", test.size, test.chunkSize, got, test.want)
+		}
+	}
+}
+func TestDecodeChunkSize(t *testing.T) {
+	data := []byte("a file split into sixteen byte chunks")
+	raw := storedFile(data, 16)
+	archive := append(make([]byte, 100), raw...)
+	d := decoder{archive: bytes.NewReader(archive), chunkSize: 16}
+	var out bytes.Buffer
+	fd := FileData{DataOffset: 100, FileSize: uint32(len(data))}
+	if err := d.decodeFile(fd, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != string(data) {
+		t.Errorf("Got %q, wanted %q", out.String(), data)
+	}
+}
+func TestInflateHugeSize(t *testing.T) {
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte("Cavedog"))
+	zw.Close()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := inflate(z.Bytes(), 0xfffffff0)
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Got %v, wanted %v", err, io.ErrUnexpectedEOF)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("Got %d bytes allocated, wanted at most %d", alloc, 1<<20)
+	}
+}
+func TestInflateChecksum(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	// A full chunk's checksum is only read after its last byte, so it is
+	// checked separately from shorter ones.
+	for _, size := range []int{300, 5000, MaxChunkSize} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(r.Intn(16))
+		}
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(data)
+		zw.Close()
+		stored := z.Bytes()
+		stored[len(stored)-1] ^= 0xff
+		_, err := inflate(stored, size)
+		if !errors.Is(err, zlib.ErrChecksum) {
+			t.Errorf("size %d: Got %v, wanted %v", size, err, zlib.ErrChecksum)
+		} else if strings.Contains(err.Error(), "ended after") {
+			t.Errorf("size %d: Got %q, wanted no mention of a short stream", size, err)
+		}
+	}
+}
+func TestInflateTruncated(t *testing.T) {
+	data := bytes.Repeat([]byte("Cavedog "), 1000)
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(data)
+	zw.Close()
+	tests := []struct {
+		stored []byte
+		size   int
+		ok     bool
+	}{
+		{z.Bytes(), len(data), true},
+		{z.Bytes()[:z.Len()/2], len(data), false},
+		{z.Bytes(), len(data) + 1, false},
+		{z.Bytes(), len(data) - 1, false},
+	}
+	for i, test := range tests {
+		chunk := ChunkHeader{
+			Marker:            ChunkStart,
+			CompressionMethod: 2,
+			CompressedSize:    uint32(len(test.stored)),
+			DecompressedSize:  uint32(test.size),
+		}
+		var archive bytes.Buffer
+		binary.Write(&archive, binary.LittleEndian, uint32(binary.Size(chunk)+len(test.stored)))
+		binary.Write(&archive, binary.LittleEndian, chunk)
+		archive.Write(test.stored)
+		d := decoder{archive: bytes.NewReader(archive.Bytes()), chunkSize: MaxChunkSize}
+		var out bytes.Buffer
+		err := d.decodeFile(FileData{FileSize: uint32(test.size)}, &out)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: Got %v, wanted ok %v", i, err, test.ok)
+		}
+		if test.ok && !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("%d: contents differ", i)
+		}
+	}
+}
+
+// errWriter fails every write.
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+func TestDecodeShortFile(t *testing.T) {
+	data := []byte("Cavedog")
+	for _, method := range []byte{0, 1, 2} {
+		stored, err := encodeFile(data, method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := decoder{archive: bytes.NewReader(stored), chunkSize: MaxChunkSize}
+		// FileData claims more than the chunks hold.
+		err = d.decodeFile(FileData{FileSize: uint32(len(data) + 1)}, &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), "decoded 7 bytes, wanted 8") {
+			t.Errorf("method %d: Got %v, wanted a size error", method, err)
+		}
+		err = d.decodeFile(FileData{FileSize: uint32(len(data))}, errWriter{})
+		if err == nil || err.Error() != "disk full" {
+			t.Errorf("method %d: Got %v, wanted the write error", method, err)
+		}
+	}
+}
+func TestExtractFile(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var header Header
+	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ExtractFile(file, header.GetKey(), 69)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Copyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Errorf("Got %q, wanted %q", data, want)
+	}
+	data, err = ExtractFile(file, header.GetKey(), 121)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 263256 {
+		t.Errorf("Got %d, wanted %d", len(data), 263256)
+	}
+}
+func TestWalk(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, key, dir, err := LoadDirectory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		names []string
+		sizes []uint32
+	)
+	err = Walk(file, dir, key, func(path string, fd FileData) error {
+		names = append(names, path)
+		sizes = append(sizes, fd.FileSize)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantNames := []string{"Copyright.txt", "maps/example.tnt", "maps/example.ota", "camps/useonly/example.tdf"}
+	wantSizes := []uint32{36, 263256, 2267, 0}
+	if len(names) != len(wantNames) {
+		t.Fatalf("Got %v, wanted %v", names, wantNames)
+	}
+	for i := range wantNames {
+		if names[i] != wantNames[i] || sizes[i] != wantSizes[i] {
+			t.Errorf("Got %s (%d), wanted %s (%d)", names[i], sizes[i], wantNames[i], wantSizes[i])
+		}
+	}
+}
+func TestTraverseUnsafeName(t *testing.T) {
+	for _, name := range []string{"../../evil.txt", `..\..\evil.txt`, "/evil.txt"} {
+		var dir bytes.Buffer
+		nameOffset := uint32(8 + 9)
+		binary.Write(&dir, binary.LittleEndian, uint32(1))
+		binary.Write(&dir, binary.LittleEndian, uint32(8))
+		binary.Write(&dir, binary.LittleEndian, Entry{
+			NameOffset:    nameOffset,
+			DirDataOffset: nameOffset + uint32(len(name)) + 1,
+		})
+		dir.WriteString(name + "\x00")
+		binary.Write(&dir, binary.LittleEndian, FileData{})
+		root := t.TempDir()
+		dest := filepath.Join(root, "a", "b")
+		err := TraverseTree(bytes.NewReader(nil), bytes.NewReader(dir.Bytes()), 0, dest, 0)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if _, err := os.Stat(filepath.Join(root, "evil.txt")); err == nil {
+			t.Errorf("%s: a file escaped the destination", name)
+		}
+	}
+}
+func TestTraverseEmbeddedSeparator(t *testing.T) {
+	const name = "sub/inner.txt"
+	var dir bytes.Buffer
+	nameOffset := uint32(8 + 9)
+	binary.Write(&dir, binary.LittleEndian, uint32(1))
+	binary.Write(&dir, binary.LittleEndian, uint32(8))
+	binary.Write(&dir, binary.LittleEndian, Entry{
+		NameOffset:    nameOffset,
+		DirDataOffset: nameOffset + uint32(len(name)) + 1,
+	})
+	dir.WriteString(name + "\x00")
+	data := []byte("Copyright 1998 Cavedog Entertainment")
+	binary.Write(&dir, binary.LittleEndian, FileData{
+		DataOffset: uint32(dir.Len() + binary.Size(FileData{})),
+		FileSize:   uint32(len(data)),
+	})
+	dir.Write(storedFile(data, MaxChunkSize))
+	archive := bytes.NewReader(dir.Bytes())
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := TraverseTree(archive, archive, 0, dest, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dest, "sub", "inner.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Got %q, wanted %q", got, data)
+	}
+}
+
+// oneByteReader returns at most one byte from each Read, as pipes and
+// network streams may.
+type oneByteReader struct {
+	io.ReadSeeker
+}
+
+func (r oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.ReadSeeker.Read(p)
+}
+func TestReadAndDecryptShortReads(t *testing.T) {
+	buf, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header Header
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	size, key := int(header.DirectorySize-header.Start), header.GetKey()
+	want, err := ReadAndDecrypt(bytes.NewReader(buf), key, size, int(header.Start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadAndDecrypt(oneByteReader{bytes.NewReader(buf)}, key, size, int(header.Start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("one-byte reads decrypt differently")
+	}
+	if _, err := ReadAndDecrypt(oneByteReader{bytes.NewReader(buf)}, key, 100, len(buf)-10); err != io.ErrUnexpectedEOF {
+		t.Errorf("Got %v, wanted %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestDecodeChunkTableError(t *testing.T) {
+	archive := storedFile([]byte("short"), MaxChunkSize)
+	d := decoder{archive: bytes.NewReader(archive), chunkSize: MaxChunkSize}
+	fd := FileData{DataOffset: uint32(len(archive)) - 2, FileSize: 5}
+	err := d.decodeFile(fd, &bytes.Buffer{})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Got %v, wanted %v", err, io.ErrUnexpectedEOF)
+	}
+}
+func TestDecompressErrors(t *testing.T) {
+	tests := []struct {
+		input []byte
+		want  string
+		ok    bool
+	}{
+		{[]byte{0x08, 'a', 'b', 'c', 0, 0}, "abc", true},
+		{[]byte{0x00, 'a', 'b', 'c'}, "", false},
+		{[]byte{0x08, 'a', 'b', 'c', 0}, "", false},
+		{[]byte{0x00, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h'}, "", false},
+		{[]byte{0x0c, 'a', 'b', 0x10, 0x00, 0, 0}, "abab", true},
+		// Streams that run out once the size is reached, without a
+		// terminator, with the last tag byte partly or wholly used.
+		{nil, "", true},
+		{[]byte{0x00, 'a', 'b', 'c'}, "abc", true},
+		{[]byte{0x08, 'a', 'b', 'c', 0}, "abc", true},
+		{[]byte{0x00, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h'}, "abcdefgh", true},
+		{[]byte{0x0c, 'a', 'b', 0x10, 0x00}, "abab", true},
+	}
+	for _, test := range tests {
+		got, err := Decompress(test.input, len(test.want))
+		if (err == nil) != test.ok || string(got) != test.want {
+			t.Errorf("Decompress(%q): Got %q, %v, wanted %q", test.input, got, err, test.want)
+		}
+	}
+	// Streams that run out short of the size, at a literal and inside a
+	// back-reference.
+	for _, input := range [][]byte{{0x00, 'a', 'b', 'c'}, {0x0c, 'a', 'b', 0x10}} {
+		if got, err := Decompress(input, 4); err == nil {
+			t.Errorf("Decompress(%q): Got %q, wanted an error", input, got)
+		}
+	}
+}
+func TestDecompressBounded(t *testing.T) {
+	// A literal and then a million back-references repeating it without
+	// ever terminating, which would decode to 17MB.
+	input := []byte{0xfe, 'a'}
+	for i := 0; i < 1000000; i++ {
+		if i%8 == 7 {
+			input = append(input, 0xff)
+		}
+		input = append(input, 0x1f, 0x00)
+	}
+	got, err := Decompress(input, 100)
+	if err == nil || !strings.Contains(err.Error(), "past 100 bytes") {
+		t.Errorf("Got %d bytes, %v, wanted an error", len(got), err)
+	}
+	if _, err := Decompress([]byte{0x08, 'a', 'b', 'c', 0, 0}, 4); err == nil {
+		t.Error("expected an error for a stream shorter than its size")
+	}
+}
+func TestDecompressHugeSize(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := Decompress([]byte{0x00, 'a', 'b', 'c', 'd', 'e', 'f', 'g'}, 0xfffffff0)
+	runtime.ReadMemStats(&after)
+	if err == nil {
+		t.Error("expected an error for a stream shorter than its size")
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("Got %d bytes allocated, wanted at most %d", alloc, 1<<20)
+	}
+}
+func TestDecompressUnwrittenWindow(t *testing.T) {
+	for _, input := range [][]byte{
+		// A back-reference to the third byte when two have been written.
+		{0x0c, 'a', 'b', 0x30, 0x00, 0, 0},
+		// One to the end of the window, which wraps around to slot 0.
+		{0x0c, 'a', 'b', 0xf0, 0xff, 0, 0},
+	} {
+		_, err := Decompress(input, 5)
+		if err == nil || !strings.Contains(err.Error(), "before it is written") {
+			t.Errorf("Decompress(%q): Got %v, wanted an unwritten window error", input, err)
+		}
+	}
+}
+func TestNewDecompressor(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 50; n++ {
+		input := make([]byte, r.Intn(20000))
+		alphabet := 1 + r.Intn(256)
+		for i := range input {
+			input[i] = byte(r.Intn(alphabet))
+		}
+		compressed := Compress(input)
+		// A bytes.Reader is read directly and a oneByteReader through a
+		// bufio.Reader.
+		for _, src := range []io.Reader{bytes.NewReader(compressed), oneByteReader{bytes.NewReader(compressed)}} {
+			got, err := io.ReadAll(NewDecompressor(src, len(input)))
+			if err != nil {
+				t.Fatalf("size %d, alphabet %d: %v", len(input), alphabet, err)
+			}
+			if !bytes.Equal(got, input) {
+				t.Fatalf("size %d, alphabet %d: Got %d bytes, wanted %d", len(input), alphabet, len(got), len(input))
+			}
+		}
+	}
+}
+func TestNewDecompressorErrors(t *testing.T) {
+	// Every stream Decompress is tested with is accepted or rejected in
+	// the same way.
+	tests := []struct {
+		input []byte
+		size  int
+	}{
+		{[]byte{0x08, 'a', 'b', 'c', 0, 0}, 3},
+		{[]byte{0x08, 'a', 'b', 'c', 0, 0}, 4},
+		{[]byte{0x00, 'a', 'b', 'c'}, 3},
+		{[]byte{0x00, 'a', 'b', 'c'}, 4},
+		{[]byte{0x00, 'a', 'b', 'c'}, 0},
+		{[]byte{0x08, 'a', 'b', 'c', 0}, 3},
+		{[]byte{0x08, 'a', 'b', 'c', 0}, 0},
+		{[]byte{0x00, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h'}, 8},
+		{[]byte{0x00, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h'}, 0},
+		{[]byte{0x0c, 'a', 'b', 0x10, 0x00, 0, 0}, 4},
+		{[]byte{0x0c, 'a', 'b', 0x10, 0x00}, 4},
+		{[]byte{0x0c, 'a', 'b', 0x10}, 4},
+		{[]byte{0x0c, 'a', 'b', 0x30, 0x00, 0, 0}, 5},
+		{[]byte{0x0c, 'a', 'b', 0xf0, 0xff, 0, 0}, 5},
+		{[]byte{0xfe, 'a', 0x1f, 0x00, 0x1f, 0x00}, 20},
+		{nil, 0},
+		{nil, 1},
+	}
+	for _, test := range tests {
+		want, wantErr := Decompress(test.input, test.size)
+		got, err := io.ReadAll(NewDecompressor(bytes.NewReader(test.input), test.size))
+		if wantErr != nil {
+			if err == nil || err.Error() != wantErr.Error() {
+				t.Errorf("NewDecompressor(%q, %d): Got %v, wanted %v", test.input, test.size, err, wantErr)
+			}
+		} else if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("NewDecompressor(%q, %d): Got %q, %v, wanted %q", test.input, test.size, got, err, want)
+		}
+	}
+}
+func TestCompressRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		size := r.Intn(20000)
+		input := make([]byte, size)
+		// Small alphabets make for plenty of matches, overlapping ones
+		// included; the full byte range makes for mostly literals.
+		alphabet := 1 + r.Intn(256)
+		for i := range input {
+			input[i] = byte(r.Intn(alphabet))
+		}
+		got, err := Decompress(Compress(input), len(input))
+		if err != nil {
+			t.Fatalf("size %d, alphabet %d: %v", size, alphabet, err)
+		}
+		if !bytes.Equal(got, input) {
+			t.Fatalf("size %d, alphabet %d: round trip differs", size, alphabet)
+		}
+	}
+}
+func TestCompressRatio(t *testing.T) {
+	input := bytes.Repeat([]byte("Copyright 1998 Cavedog Entertainment\n"), 2000)
+	compressed := Compress(input)
+	if len(compressed) > len(input)/4 {
+		t.Errorf("Got %d bytes, wanted at most %d", len(compressed), len(input)/4)
+	}
+	got, err := Decompress(compressed, len(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Error("round trip differs")
+	}
+}
+func BenchmarkCompress(b *testing.B) {
+	input := bytes.Repeat([]byte("Copyright 1998 Cavedog Entertainment\n"), 1800)[:MaxChunkSize]
+	b.SetBytes(int64(len(input)))
+	for i := 0; i < b.N; i++ {
+		Compress(input)
+	}
+}
+
+func BenchmarkDecompressRepetitive(b *testing.B) {
+	input := bytes.Repeat([]byte("Copyright 1998 Cavedog Entertainment\n"), 1<<17)
+	compressed := Compress(input)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decompress(compressed, len(input)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+func BenchmarkNewDecompressorRepetitive(b *testing.B) {
+	input := bytes.Repeat([]byte("Copyright 1998 Cavedog Entertainment\n"), 1<<17)
+	compressed := Compress(input)
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := NewDecompressor(bytes.NewReader(compressed), len(input))
+		if _, err := io.CopyBuffer(io.Discard, r, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// cancellingReader cancels a context once it has been read from n times.
+type cancellingReader struct {
+	io.ReadSeeker
+	n      int
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	if r.n--; r.n == 0 {
+		r.cancel()
+	}
+	return r.ReadSeeker.Read(p)
+}
+func TestProcessFileContext(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header, key, dir, err := LoadDirectory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+
+	// Cancel once the chunks of maps/example.tnt have been read, before
+	// the first is decoded.
+	ctx, cancel := context.WithCancel(context.Background())
+	archive := &cancellingReader{ReadSeeker: file, n: 2, cancel: cancel}
+	name := filepath.Join(dest, "example.tnt")
+	if err := ProcessFileContext(ctx, archive, dir, key, name, 121); err != context.Canceled {
+		t.Errorf("Got %v, wanted %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("partial file was left behind: %v", err)
+	}
+	if err := TraverseTreeContext(ctx, file, dir, key, dest, int(header.Start)); err != context.Canceled {
+		t.Errorf("Got %v, wanted %v", err, context.Canceled)
+	}
+	if err := ProcessFileContext(context.Background(), file, dir, key, name, 121); err != nil {
+		t.Error(err)
+	}
+}
+func TestTraverseTreeProgress(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header, key, dir, err := LoadDirectory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	var (
+		calls = make(map[string]int)
+		last  = make(map[string][2]int64)
+	)
+	opts := ExtractOptions{
+		Progress: func(name string, written, total int64) {
+			calls[name]++
+			last[name] = [2]int64{written, total}
+		},
+	}
+	if err := TraverseTreeOptions(context.Background(), file, dir, key, dest, int(header.Start), opts); err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string]int64{
+		"Copyright.txt":             36,
+		"maps/example.tnt":          263256,
+		"maps/example.ota":          2267,
+		"camps/useonly/example.tdf": 0,
+	}
+	for name, size := range sizes {
+		got := last[path.Join(dest, name)]
+		if got[0] != size || got[1] != size {
+			t.Errorf("%s: Got %d of %d, wanted %d of %d", name, got[0], got[1], size, size)
+		}
+	}
+	// One call before writing and one for each of the five chunks.
+	if n := calls[path.Join(dest, "maps/example.tnt")]; n != 6 {
+		t.Errorf("Got %d calls, wanted %d", n, 6)
+	}
+}
+func TestExtractPath(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header, key, dir, err := LoadDirectory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := int(header.Start)
+	tests := []struct {
+		path string
+		size uint32
+		ok   bool
+	}{
+		{"maps/example.ota", 2267, true},
+		{"MAPS/Example.OTA", 2267, true},
+		{"camps/useonly/example.tdf", 0, true},
+		{"camps/useonly", 0, false},
+		{"maps/missing.tnt", 0, false},
+		{"Copyright.txt/x", 0, false},
+	}
+	for _, test := range tests {
+		fd, ok, err := FindEntry(dir, key, start, test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.ok || fd.FileSize != test.size {
+			t.Errorf("%s: Got %v with size %d, wanted %v with size %d", test.path, ok, fd.FileSize, test.ok, test.size)
+		}
+	}
+	data, err := ExtractPath(file, dir, key, start, "copyright.TXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Copyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Errorf("Got %q, wanted %q", data, want)
+	}
+	if _, err := ExtractPath(file, dir, key, start, "maps/missing.tnt"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+func TestFindEntryStart(t *testing.T) {
+	// A directory whose root is at 40 rather than right after the header,
+	// as the Writer lays out one that outgrows its reserve.
+	const start, name = 40, "Copyright.txt"
+	dir := bytes.NewBuffer(make([]byte, start))
+	binary.Write(dir, binary.LittleEndian, []uint32{1, start + 8})
+	binary.Write(dir, binary.LittleEndian, Entry{
+		NameOffset:    start + 8 + 9,
+		DirDataOffset: start + 8 + 9 + uint32(len(name)) + 1,
+	})
+	dir.WriteString(name + "\x00")
+	binary.Write(dir, binary.LittleEndian, FileData{FileSize: 36})
+	r := bytes.NewReader(dir.Bytes())
+	fd, ok, err := FindEntry(r, 0, start, "copyright.txt")
+	if err != nil || !ok || fd.FileSize != 36 {
+		t.Errorf("Got %v, %v, %v, wanted a file of %d bytes", fd, ok, err, 36)
+	}
+	if _, ok, err := FindEntryExact(r, 0, start, name); err != nil || !ok {
+		t.Errorf("FindEntryExact: Got %v, %v, wanted the file", ok, err)
+	}
+	if fd, err := Stat(r, 0, start, name); err != nil || fd.FileSize != 36 {
+		t.Errorf("Stat: Got %v, %v, wanted a file of %d bytes", fd, err, 36)
+	}
+}
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{`gamedata\SIDEDATA.TDF`, "gamedata/sidedata.tdf"},
+		{"gamedata/sidedata.tdf", "gamedata/sidedata.tdf"},
+		{`\Maps\Example.TNT\`, "maps/example.tnt"},
+		{`units/ARMCOM.fbi`, "units/armcom.fbi"},
+	}
+	for _, test := range tests {
+		if got := NormalizePath(test.name); got != test.want {
+			t.Errorf("NormalizePath(%q): Got %q, wanted %q", test.name, got, test.want)
+		}
+	}
+}
+func TestFindEntryExact(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header, key, dir, err := LoadDirectory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := int(header.Start)
+	tests := []struct {
+		path         string
+		loose, exact bool
+	}{
+		{"maps/example.ota", true, true},
+		{`MAPS\Example.OTA`, true, false},
+		{`camps\useonly/EXAMPLE.tdf`, true, false},
+		{"copyright.txt", true, false},
+		{"Copyright.txt", true, true},
+	}
+	for _, test := range tests {
+		if _, ok, err := FindEntry(dir, key, start, test.path); err != nil || ok != test.loose {
+			t.Errorf("FindEntry(%q): Got %v, %v, wanted %v", test.path, ok, err, test.loose)
+		}
+		if _, ok, err := FindEntryExact(dir, key, start, test.path); err != nil || ok != test.exact {
+			t.Errorf("FindEntryExact(%q): Got %v, %v, wanted %v", test.path, ok, err, test.exact)
+		}
+	}
+}
+func TestDecryptInPlace(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var header Header
+	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ReadAndDecrypt(file, header.GetKey(), 64, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := append([]byte(nil), raw[30:94]...)
+	DecryptInPlace(buf, header.GetKey(), 30)
+	if !bytes.Equal(buf, want) {
+		t.Errorf("Got %x, wanted %x", buf, want)
+	}
+	DecryptInPlace(buf, header.GetKey(), 30)
+	if !bytes.Equal(buf, raw[30:94]) {
+		t.Errorf("Got %x, wanted %x", buf, raw[30:94])
+	}
+}
+
+// openDirectory opens an HPI file with the free functions, returning it, its
+// key, its decrypted directory and the offset of the root directory.
+func openDirectory(tb testing.TB, name string) (*os.File, byte, *bytes.Reader, int) {
+	file, err := os.Open(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { file.Close() })
+	header, key, dir, err := LoadDirectory(file)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return file, key, dir, int(header.Start)
+}
+func TestExtractParallel(t *testing.T) {
+	file, key, dir, offset := openDirectory(t, "Example.ufo")
+	want := t.TempDir()
+	if err := TraverseTree(file, dir, key, want, offset); err != nil {
+		t.Fatal(err)
+	}
+	got := t.TempDir()
+	if err := ExtractParallel(context.Background(), file, dir, key, got, offset, 3); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Copyright.txt", "maps/example.tnt", "maps/example.ota", "camps/useonly/example.tdf"} {
+		a, err := os.ReadFile(filepath.Join(want, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(got, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Errorf("%s: contents differ", name)
+		}
+	}
+	// A corrupt chunk fails the extraction.
+	raw, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[229] ^= 0xff // The compression method of Copyright.txt.
+	broken := bytes.NewReader(raw)
+	if err := ExtractParallel(context.Background(), broken, dir, key, t.TempDir(), offset, 3); err == nil {
+		t.Error("expected an error extracting a corrupt archive")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ExtractParallel(ctx, file, dir, key, t.TempDir(), offset, 3); !errors.Is(err, context.Canceled) {
+		t.Errorf("Got %v, wanted %v", err, context.Canceled)
+	}
+}
+func BenchmarkExtractParallel(b *testing.B) {
+	name := filepath.Join(b.TempDir(), "many.hpi")
+	out, err := os.Create(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := NewWriter(out, 0x42)
+	data := make([]byte, 16*1024)
+	for i := range data {
+		data[i] = byte(i * i >> 5)
+	}
+	for i := 0; i < 500; i++ {
+		if err := w.AddFile(fmt.Sprintf("units/unit%03d.fbi", i), data, 2); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+	out.Close()
+	file, key, dir, offset := openDirectory(b, name)
+	for _, workers := range []int{1, 0} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := ExtractParallel(context.Background(), file, dir, key, b.TempDir(), offset, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+func BenchmarkExtractMany(b *testing.B) {
+	name := filepath.Join(b.TempDir(), "many.hpi")
+	out, err := os.Create(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := NewWriter(out, 0x42)
+	data := make([]byte, 8*1024)
+	for i := range data {
+		data[i] = byte(i * i >> 5)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := w.AddFile(fmt.Sprintf("units/unit%04d.fbi", i), data, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+	out.Close()
+	file, err := os.Open(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		a.Options.Sink = &memSink{files: make(map[string]*bytes.Buffer), dirs: make(map[string]bool)}
+		if _, err := a.ExtractMapped("out"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+func TestPutFileBuffer(t *testing.T) {
+	big := make([]byte, maxPooledBuffer+1)
+	putFileBuffer(&big)
+	if buf := fileBuffers.Get().(*[]byte); cap(*buf) > maxPooledBuffer {
+		t.Errorf("Got a pooled buffer of %d bytes, wanted at most %d", cap(*buf), maxPooledBuffer)
+	}
+}
+func TestDecryptInPlaceWords(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 500; n++ {
+		buf := make([]byte, r.Intn(2000))
+		r.Read(buf)
+		key, offset := byte(1+r.Intn(255)), r.Intn(1<<20)
+		want := make([]byte, len(buf))
+		for i := range buf {
+			want[i] = buf[i] ^ byte(offset+i) ^ key
+		}
+		DecryptInPlace(buf, key, offset)
+		if !bytes.Equal(buf, want) {
+			t.Fatalf("%d bytes at %d with key %x: Got %x, wanted %x", len(buf), offset, key, buf, want)
+		}
+	}
+}
+func BenchmarkDecryptInPlace(b *testing.B) {
+	buf := make([]byte, 4<<20)
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		DecryptInPlace(buf, 0xbe, 20)
+	}
+}
+func TestReadAndDecryptAt(t *testing.T) {
+	file, key, dir, offset := openDirectory(t, "Example.ufo")
+	want := make([]byte, dir.Len()-offset)
+	if _, err := dir.ReadAt(want, int64(offset)); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, len(want))
+	for i := 0; i+16 <= len(want); i += 16 {
+		go func(i int) {
+			got, err := ReadAndDecryptAt(file, key, 16, offset+i)
+			if err == nil && !bytes.Equal(got, want[i:i+16]) {
+				err = fmt.Errorf("%d: Got %x, wanted %x", offset+i, got, want[i:i+16])
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i+16 <= len(want); i += 16 {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := ReadAndDecryptAt(file, key, 16, 1<<20); err != io.ErrUnexpectedEOF {
+		t.Errorf("Got %v, wanted %v", err, io.ErrUnexpectedEOF)
+	}
+}
+func TestTraverseTreeModes(t *testing.T) {
+	file, key, dir, offset := openDirectory(t, "Example.ufo")
+	dest := filepath.Join(t.TempDir(), "out")
+	opts := ExtractOptions{DirMode: 0700, FileMode: 0600}
+	if err := TraverseTreeOptions(context.Background(), file, dir, key, dest, offset, opts); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]os.FileMode{
+		"":                          os.ModeDir | 0700,
+		"maps":                      os.ModeDir | 0700,
+		"camps/useonly":             os.ModeDir | 0700,
+		"Copyright.txt":             0600,
+		"camps/useonly/example.tdf": 0600,
+	} {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s: Got %v, wanted %v", name, info.Mode(), want)
+		}
+	}
+}
+func TestTotalSize(t *testing.T) {
+	_, key, dir, offset := openDirectory(t, "Example.ufo")
+	size, err := TotalSize(dir, key, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(36 + 263256 + 2267); size != want {
+		t.Errorf("Got %d, wanted %d", size, want)
+	}
+	_, files, err := Totals(dir, key, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 4 {
+		t.Errorf("Got %d, wanted %d", files, 4)
+	}
+	if _, err := TotalSize(bytes.NewReader(wideDirectory(10, false)[:50]), key, 0); err == nil {
+		t.Error("expected an error for a truncated directory")
+	}
+}
+func TestEachEntry(t *testing.T) {
+	_, key, dir, offset := openDirectory(t, "Example.ufo")
+	var got []string
+	err := EachEntry(dir, key, offset, func(path string, isDir bool) error {
+		if isDir {
+			path += "/"
+		}
+		got = append(got, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Copyright.txt", "maps/", "maps/example.tnt", "maps/example.ota", "camps/", "camps/useonly/", "camps/useonly/example.tdf"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+	stop := errors.New("stop")
+	var n int
+	err = EachEntry(dir, key, offset, func(path string, isDir bool) error {
+		if n++; path == "maps/example.tnt" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Errorf("Got %v after %d entries, wanted %v after 3", err, n, stop)
+	}
+}
+func TestDirectoryLoop(t *testing.T) {
+	// The root lists itself as its only subdirectory.
+	var dir bytes.Buffer
+	binary.Write(&dir, binary.LittleEndian, []uint32{1, headerSize + 8})
+	binary.Write(&dir, binary.LittleEndian, Entry{NameOffset: headerSize + 17, DirDataOffset: headerSize, Flag: 1})
+	dir.WriteString("loop\x00")
+	archive := withDirectory(dir.Bytes())
+	padded := bytes.NewReader(append(make([]byte, headerSize), dir.Bytes()...))
+	if err := EachEntry(padded, 0, headerSize, func(string, bool) error { return nil }); err == nil {
+		t.Error("EachEntry: expected an error for a directory loop")
+	}
+	if _, _, err := Totals(padded, 0, headerSize); err == nil {
+		t.Error("Totals: expected an error for a directory loop")
+	}
+	if err := TraverseTree(bytes.NewReader(archive), padded, 0, t.TempDir(), headerSize); err == nil {
+		t.Error("TraverseTree: expected an error for a directory loop")
+	}
+	a, err := Open(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ListWithDepth(); err == nil {
+		t.Error("ListWithDepth: expected an error for a directory loop")
+	}
+}
+func TestTraverseTreeContinueOnError(t *testing.T) {
+	raw, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Damage the compression method of Copyright.txt's only chunk.
+	raw[229] ^= 0xff
+	header, key, dir, err := LoadDirectory(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	err = TraverseTree(bytes.NewReader(raw), dir, key, dest, int(header.Start))
+	if !errors.Is(err, ErrUnknownCompression) || !strings.Contains(err.Error(), "Copyright.txt\" at offset 69") {
+		t.Errorf("Got %v, wanted an unknown compression error for Copyright.txt at offset 69", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "maps")); err == nil {
+		t.Error("expected extraction to stop at the first error")
+	}
+	dest = t.TempDir()
+	opts := ExtractOptions{ContinueOnError: true}
+	err = TraverseTreeOptions(context.Background(), bytes.NewReader(raw), dir, key, dest, int(header.Start), opts)
+	if !errors.Is(err, ErrUnknownCompression) {
+		t.Errorf("Got %v, wanted %v", err, ErrUnknownCompression)
+	}
+	for _, name := range []string{"maps/example.tnt", "maps/example.ota", "camps/useonly/example.tdf"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "Copyright.txt")); err == nil {
+		t.Error("expected the damaged file to be removed")
+	}
+}
+func TestCorruptDirectory(t *testing.T) {
+	// node builds a root directory with one entry and the name "a".
+	node := func(numEntries, entryOffset uint32, e Entry, name string) []byte {
+		var dir bytes.Buffer
+		binary.Write(&dir, binary.LittleEndian, []uint32{numEntries, entryOffset})
+		binary.Write(&dir, binary.LittleEndian, e)
+		dir.WriteString(name)
+		dir.Write(make([]byte, 9))
+		return dir.Bytes()
+	}
+	const names = headerSize + 17
+	tests := map[string][]byte{
+		"huge count":        node(0xffffffff, headerSize+8, Entry{NameOffset: names, DirDataOffset: names + 2}, "a\x00"),
+		"table past end":    node(1, 1<<20, Entry{NameOffset: names, DirDataOffset: names + 2}, "a\x00"),
+		"name past end":     node(1, headerSize+8, Entry{NameOffset: 1 << 20, DirDataOffset: names + 2}, "a\x00"),
+		"data past end":     node(1, headerSize+8, Entry{NameOffset: names, DirDataOffset: 1 << 20}, "a\x00"),
+		"subdir past end":   node(1, headerSize+8, Entry{NameOffset: names, DirDataOffset: names + 4, Flag: 1}, "a\x00"),
+		"unterminated name": node(1, headerSize+8, Entry{NameOffset: names, DirDataOffset: headerSize}, "aa"),
+	}
+	for name, dir := range tests {
+		// Leave no NUL after the name for the unterminated case.
+		if name == "unterminated name" {
+			dir = dir[:len(dir)-9]
+		}
+		padded := bytes.NewReader(append(make([]byte, headerSize), dir...))
+		if err := EachEntry(padded, 0, headerSize, func(string, bool) error { return nil }); !errors.Is(err, ErrCorruptDirectory) {
+			t.Errorf("%s: EachEntry: Got %v, wanted %v", name, err, ErrCorruptDirectory)
+		}
+		a, err := Open(bytes.NewReader(withDirectory(dir)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.ListWithDepth(); !errors.Is(err, ErrCorruptDirectory) {
+			t.Errorf("%s: ListWithDepth: Got %v, wanted %v", name, err, ErrCorruptDirectory)
+		}
+		if a, err = OpenLazy(bytes.NewReader(withDirectory(dir))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.FirstChunk("a/b"); !errors.Is(err, ErrCorruptDirectory) {
+			t.Errorf("%s: FirstChunk: Got %v, wanted %v", name, err, ErrCorruptDirectory)
+		}
+	}
+}
+func TestStat(t *testing.T) {
+	_, key, dir, start := openDirectory(t, "Example.ufo")
+	fd, err := Stat(dir, key, start, "MAPS/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd.FileSize != 263256 || fd.Compression() != 1 {
+		t.Errorf("Got %d bytes with method %d, wanted %d with %d", fd.FileSize, fd.Compression(), 263256, 1)
+	}
+	for _, name := range []string{"maps/missing.tnt", "maps", "maps/example.tnt/x"} {
+		if _, err := Stat(dir, key, start, name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: Got %v, wanted %v", name, err, ErrNotFound)
+		}
+	}
+}
+func TestTraverseTreeSkip(t *testing.T) {
+	file, key, dir, offset := openDirectory(t, "Example.ufo")
+	var seen []string
+	opts := ExtractOptions{Skip: func(path string, isDir bool) bool {
+		seen = append(seen, path)
+		return path == "maps" && isDir || path == "Copyright.txt" && !isDir
+	}}
+	dest := t.TempDir()
+	if err := TraverseTreeOptions(context.Background(), file, dir, key, dest, offset, opts); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Copyright.txt", "maps", "camps", "camps/useonly", "camps/useonly/example.tdf"}
+	if strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Errorf("Got %q, wanted %q", seen, want)
+	}
+	for name, extracted := range map[string]bool{"Copyright.txt": false, "maps": false, "camps/useonly/example.tdf": true} {
+		if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name))); (err == nil) != extracted {
+			t.Errorf("%s: Got %v, wanted extracted %v", name, err, extracted)
+		}
+	}
+}
+func TestExtractGlob(t *testing.T) {
+	file, key, dir, _ := openDirectory(t, "Example.ufo")
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"MAPS/*", []string{"maps/example.tnt", "maps/example.ota"}},
+		{"*.txt", []string{"Copyright.txt"}},
+		{"*.tdf", nil},
+		{"*/*/*.tdf", []string{"camps/useonly/example.tdf"}},
+	}
+	for _, test := range tests {
+		dest := t.TempDir()
+		got, err := ExtractGlob(file, dir, key, dest, test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: Got %v, wanted %v", test.pattern, got, test.want)
+		}
+		var written []string
+		filepath.Walk(dest, func(name string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(dest, name)
+				written = append(written, filepath.ToSlash(rel))
+			}
+			return err
+		})
+		if len(written) != len(test.want) {
+			t.Errorf("%s: Got %v on disk, wanted %v", test.pattern, written, test.want)
+		}
+	}
+	if _, err := ExtractGlob(file, dir, key, t.TempDir(), "maps/["); err == nil {
+		t.Error("expected an error for a bad pattern")
+	}
+}
+func TestLoadDirectory(t *testing.T) {
+	file, key, dir, offset := openDirectory(t, "Example.ufo")
+	if key != 190 || offset != 20 {
+		t.Errorf("Got key %d at %d, wanted %d at %d", key, offset, 190, 20)
+	}
+	// Copyright.txt's FileData is at 69 in the file, and in dir.
+	dir.Seek(69, io.SeekStart)
+	var fd FileData
+	if err := binary.Read(dir, binary.LittleEndian, &fd); err != nil {
+		t.Fatal(err)
+	}
+	if fd.DataOffset != 220 || fd.FileSize != 36 {
+		t.Errorf("Got %+v, wanted data at %d of size %d", fd, 220, 36)
+	}
+	raw, err := ioutil.ReadAll(io.NewSectionReader(file, 0, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{nil, raw[:10], raw} {
+		if _, _, _, err := LoadDirectory(bytes.NewReader(data)); err == nil {
+			t.Errorf("%d bytes: expected an error", len(data))
+		}
+	}
+}
+func TestProcessFileRemovesPartialFile(t *testing.T) {
+	_, key, dir, _ := openDirectory(t, "Example.ufo")
+	raw, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[229] ^= 0xff // The compression method of Copyright.txt.
+	name := filepath.Join(t.TempDir(), "Copyright.txt")
+	if err := ProcessFile(bytes.NewReader(raw), dir, key, name, 69); err == nil {
+		t.Fatal("expected an error extracting a corrupt file")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Got %v, wanted the partial file to be removed", err)
+	}
+}
+func TestSentinelErrors(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Extract("maps/missing.tnt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got %v, wanted %v", err, ErrNotFound)
+	}
+	if _, err := Open(bytes.NewReader(make([]byte, 100))); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("Got %v, wanted %v", err, ErrBadMagic)
+	}
+	d := decoder{archive: bytes.NewReader(methodFile([]byte("data"), 0x7f)), chunkSize: MaxChunkSize}
+	err = d.decodeFile(FileData{FileSize: 4}, &bytes.Buffer{})
+	var unknown *UnknownCompressionError
+	if !errors.Is(err, ErrUnknownCompression) || !errors.As(err, &unknown) || unknown.Method != 0x7f {
+		t.Errorf("Got %v, wanted an unknown compression error for method 7f", err)
+	}
+	raw, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[250] ^= 0xff // Inside the chunk data of Copyright.txt.
+	b, err := Open(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Validate(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Got %v, wanted %v", err, ErrChecksumMismatch)
+	}
+	stored := storedFile([]byte("data"), MaxChunkSize)
+	stored[4+7]++ // The chunk claims more data than it holds.
+	d = decoder{archive: bytes.NewReader(stored), chunkSize: MaxChunkSize}
+	if err := d.decodeFile(FileData{FileSize: 4}, &bytes.Buffer{}); !errors.Is(err, ErrShortRead) {
+		t.Errorf("Got %v, wanted %v", err, ErrShortRead)
+	}
+}
+func TestExtractAll(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "a", "b")
+	if err := ExtractAll("Example.ufo", dest); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "Copyright.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Copyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Errorf("Got %q, wanted %q", data, want)
+	}
+	info, err := os.Stat(filepath.Join(dest, "maps", "example.tnt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 263256 {
+		t.Errorf("Got %d, wanted %d", info.Size(), 263256)
+	}
+	if err := ExtractAll("missing.ufo", dest); !os.IsNotExist(err) {
+		t.Errorf("Got %v, wanted a not exist error", err)
+	}
+	if err := ExtractAll("go.mod", dest); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("Got %v, wanted %v", err, ErrBadMagic)
+	}
+}
+func TestProcessFileEmpty(t *testing.T) {
+	dir := make([]byte, 9) // FileData{FileSize: 0}.
+	name := filepath.Join(t.TempDir(), "empty.txt")
+	if err := ProcessFile(bytes.NewReader(nil), bytes.NewReader(dir), 0, name, 0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("Got %q, wanted an empty file", data)
+	}
+}
+func TestBadChunkSizes(t *testing.T) {
+	data := []byte("a file split into sixteen byte chunks")
+	tests := []struct {
+		name string
+		size uint32
+		want error
+	}{
+		{"zero", 0, nil},
+		{"huge", 0x7fffffff, nil},
+		{"overflowing", 0xffffffff, nil},
+		{"past the end", 19 + 2*16, ErrShortRead},
+	}
+	for _, test := range tests {
+		raw := storedFile(data, 16)
+		binary.LittleEndian.PutUint32(raw, test.size)
+		d := decoder{archive: bytes.NewReader(raw), chunkSize: 16}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err := d.decodeFile(FileData{FileSize: uint32(len(data))}, &bytes.Buffer{})
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: Got %v, wanted %v", test.name, err, test.want)
+		}
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+			t.Errorf("%s: Got %d bytes allocated, wanted at most %d", test.name, alloc, 1<<20)
+		}
+	}
+}
+func TestHugeDecompressedSize(t *testing.T) {
+	data := []byte("a file split into sixteen byte chunks")
+	raw := storedFile(data, 16)
+	// The DecompressedSize of the first chunk, after the three entry table.
+	binary.LittleEndian.PutUint32(raw[3*ChunkTableEntrySize+11:], 0xfffffff0)
+	raw[3*ChunkTableEntrySize+5] = 1 // LZ77, which would decode up to the size.
+	fd := FileData{FileSize: uint32(len(data))}
+	d := decoder{archive: bytes.NewReader(raw), chunkSize: 16}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err := d.decodeFile(fd, &bytes.Buffer{})
+	runtime.ReadMemStats(&after)
+	if err == nil || !strings.Contains(err.Error(), "larger than a chunk") {
+		t.Errorf("Got %v, wanted a decompressed size error", err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("Got %d bytes allocated, wanted at most %d", alloc, 1<<20)
+	}
+	if _, err := d.decodeChunkAt(19+16, 3*ChunkTableEntrySize); err == nil || !strings.Contains(err.Error(), "larger than a chunk") {
+		t.Errorf("Got %v, wanted a decompressed size error", err)
+	}
+	chunk := Chunk{ChunkHeader: ChunkHeader{CompressionMethod: 1, DecompressedSize: MaxChunkSize + 1}}
+	if _, err := DecompressChunk(chunk); err == nil || !strings.Contains(err.Error(), "larger than a chunk") {
+		t.Errorf("Got %v, wanted a decompressed size error", err)
+	}
+}
+func TestTraverseTreeUnsupportedOptions(t *testing.T) {
+	file, key, dir, offset := openDirectory(t, "Example.ufo")
+	for _, opts := range []ExtractOptions{
+		{Rename: strings.ToUpper},
+		{Quarantine: true},
+		{ExactPaths: true},
+		{SkipMissing: true},
+	} {
+		dest := t.TempDir()
+		if err := TraverseTreeOptions(context.Background(), file, dir, key, dest, offset, opts); err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("Got %v, wanted an unsupported option error", err)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dest, "*")); len(matches) != 0 {
+			t.Errorf("Got %v, wanted nothing extracted", matches)
+		}
+	}
+	// With several set, the error names the first.
+	opts := ExtractOptions{Rename: strings.ToUpper, Quarantine: true, ExactPaths: true, SkipMissing: true}
+	err := TraverseTreeOptions(context.Background(), file, dir, key, t.TempDir(), offset, opts)
+	if want := "ExtractOptions.Rename is not supported by TraverseTreeOptions"; err == nil || err.Error() != want {
+		t.Errorf("Got %v, wanted %s", err, want)
+	}
+}
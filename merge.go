@@ -0,0 +1,94 @@
+package hpi
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MergedArchive is several archives seen as one, as the game sees the HPI,
+// UFO and CCX files it loads: a path names the file in the last archive
+// that has it, hiding the files at that path in the archives before it.
+// Paths are compared after NormalizePath. Only files take part; a
+// directory does not hide files in other archives, and an archive with a
+// file where a later one has a directory keeps both.
+type MergedArchive struct {
+	archives []*Archive
+	files    map[string]mergedFile // Keyed by NormalizePath of the path.
+}
+
+// mergedFile is a path in a MergedArchive.
+type mergedFile struct {
+	archiveFile
+	sources []int // Indexes of the archives with the path, in load order.
+}
+
+// Merge opens each of archives, in load order, and merges them. Each is
+// read as by Open and must stay open while the MergedArchive is used.
+func Merge(archives []io.ReadSeeker) (*MergedArchive, error) {
+	m := &MergedArchive{files: make(map[string]mergedFile)}
+	for i, r := range archives {
+		a, err := Open(r)
+		if err != nil {
+			return nil, fmt.Errorf("archive %d: %w", i, err)
+		}
+		files, err := a.files()
+		if err != nil {
+			return nil, fmt.Errorf("archive %d: %w", i, err)
+		}
+		for _, f := range files {
+			key := NormalizePath(f.name)
+			m.files[key] = mergedFile{archiveFile: f, sources: append(m.files[key].sources, i)}
+		}
+		m.archives = append(m.archives, a)
+	}
+	return m, nil
+}
+
+// List returns the path of every file in the merged archive, sorted, each
+// spelled as in the archive it resolves to.
+func (m *MergedArchive) List() []string {
+	keys := make([]string, 0, len(m.files))
+	for key := range m.files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = m.files[key].name
+	}
+	return names
+}
+
+// Extract returns the decompressed contents of the named file from the
+// last archive that has it.
+func (m *MergedArchive) Extract(name string) ([]byte, error) {
+	f, ok := m.files[NormalizePath(name)]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	data, err := m.archives[f.sources[len(f.sources)-1]].ReadFileAt(f.fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return data, nil
+}
+
+// Sources returns the indexes, in load order, of the archives that have
+// the named file. The last is the one Extract reads; the others are
+// overridden by it. It returns nil for a path that no archive has.
+func (m *MergedArchive) Sources(name string) []int {
+	return append([]int(nil), m.files[NormalizePath(name)].sources...)
+}
+
+// Conflicts returns every path that more than one archive has, mapped to
+// the indexes of those archives in load order, as Sources returns them.
+func (m *MergedArchive) Conflicts() map[string][]int {
+	conflicts := make(map[string][]int)
+	for _, f := range m.files {
+		if len(f.sources) > 1 {
+			conflicts[f.name] = append([]int(nil), f.sources...)
+		}
+	}
+	return conflicts
+}
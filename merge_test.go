@@ -0,0 +1,79 @@
+package hpi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	base, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	mod, err := os.Create(filepath.Join(t.TempDir(), "mod.ufo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close()
+	w := NewWriter(mod, 0x11)
+	if err := w.AddFile("COPYRIGHT.TXT", []byte("Copyright the modder"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddFile("units/new.fbi", []byte("[UNITINFO]"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Merge([]io.ReadSeeker{base, mod})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"camps/useonly/example.tdf", "COPYRIGHT.TXT", "maps/example.ota", "maps/example.tnt", "units/new.fbi"}
+	if got := m.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, wanted %v", got, want)
+	}
+	data, err := m.Extract("copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "Copyright the modder" {
+		t.Errorf("Got %q, wanted %q", data, "Copyright the modder")
+	}
+	if data, err = m.Extract("maps/example.ota"); err != nil || len(data) != 2267 {
+		t.Errorf("Got %d bytes and %v, wanted %d", len(data), err, 2267)
+	}
+	if got := m.Sources("Copyright.txt"); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("Got %v, wanted %v", got, []int{0, 1})
+	}
+	if got := m.Sources("units/missing.fbi"); got != nil {
+		t.Errorf("Got %v, wanted %v", got, nil)
+	}
+	if got := m.Conflicts(); !reflect.DeepEqual(got, map[string][]int{"COPYRIGHT.TXT": {0, 1}}) {
+		t.Errorf("Got %v, wanted %v", got, map[string][]int{"COPYRIGHT.TXT": {0, 1}})
+	}
+	if _, err := m.Extract("units/missing.fbi"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got %v, wanted %v", err, ErrNotFound)
+	}
+	// In the other order the original file wins.
+	m, err = Merge([]io.ReadSeeker{mod, base})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = m.Extract("COPYRIGHT.TXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("Copyright")) || bytes.Contains(data, []byte("modder")) {
+		t.Errorf("Got %q, wanted the original", data)
+	}
+	if _, err := Merge([]io.ReadSeeker{base, bytes.NewReader([]byte("not an archive"))}); err == nil {
+		t.Error("expected an error for a bad archive")
+	}
+}
@@ -0,0 +1,34 @@
+package hpi
+
+import "bytes"
+
+// OpenMmap opens the HPI file called name by mapping it into memory, and
+// reads it as Open does. Reads then cost no system calls, which suits
+// workloads that fetch many files out of one large archive on demand, and
+// the Archive can be read from many goroutines at once. On systems without
+// mmap the file is read into memory instead. Close unmaps the file, after
+// which the Archive must not be used.
+func OpenMmap(name string) (*Archive, error) {
+	data, unmap, err := mmapFile(name)
+	if err != nil {
+		return nil, err
+	}
+	a, err := Open(bytes.NewReader(data))
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	a.unmap = unmap
+	return a, nil
+}
+
+// Close releases the memory mapping of an Archive from OpenMmap. It does
+// nothing for other Archives, whose readers belong to the caller.
+func (a *Archive) Close() error {
+	if a.unmap == nil {
+		return nil
+	}
+	err := a.unmap()
+	a.unmap = nil
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package hpi
+
+import "os"
+
+// mmapFile reads the file called name into memory, for systems where it
+// cannot be mapped.
+func mmapFile(name string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
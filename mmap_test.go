@@ -0,0 +1,40 @@
+package hpi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenMmap(t *testing.T) {
+	a, err := OpenMmap("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ValidateParallel(4); err != nil {
+		t.Error(err)
+	}
+	data, err := a.Extract("Copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Copyright 1998 Cavedog Entertainment"; string(data) != want {
+		t.Errorf("Got %q, wanted %q", data, want)
+	}
+	if err := a.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.hpi")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenMmap(empty); err == nil {
+		t.Error("expected an error for an empty file")
+	}
+	if _, err := OpenMmap(filepath.Join(t.TempDir(), "missing.hpi")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,100 @@
+package hpi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// QuarantineDir is the directory below the destination that suspicious
+	// files are extracted into when ExtractOptions.Quarantine is set.
+	QuarantineDir = "_quarantine"
+
+	// maxNameLength is the longest path component that is extracted as
+	// is, the limit of most file systems.
+	maxNameLength = 255
+)
+
+// suspicious reports whether the slash-separated path name could escape the
+// destination it is extracted to, or has a component too long to create.
+func suspicious(name string) bool {
+	if unsafePath(name) {
+		return true
+	}
+	for _, part := range strings.Split(name, "/") {
+		if len(part) > maxNameLength {
+			return true
+		}
+	}
+	return false
+}
+
+// unsafePath reports whether name, a path from an archive, could escape the
+// directory it is extracted to: it is absolute or has a ".." component.
+// Backslashes count as separators too, since TA tools wrote them and
+// Windows follows them.
+func unsafePath(name string) bool {
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) || filepath.VolumeName(filepath.FromSlash(name)) != "" {
+		return true
+	}
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether the path name, once cleaned, lies inside root.
+func within(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// quarantineName returns a file name for the suspicious path name that is
+// safe to create anywhere. Anything but letters, digits, dots, dashes and
+// underscores is replaced, and a hash of name keeps the result unique.
+func quarantineName(name string) string {
+	const keep = 64
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	if len(safe) > keep {
+		safe = safe[len(safe)-keep:]
+	}
+	sum := sha256.Sum256([]byte(name))
+	return safe + "-" + hex.EncodeToString(sum[:6])
+}
+
+// recordQuarantine adds the quarantined file called name to the manifest
+// in the quarantine directory below dest, which maps each quarantined file
+// to the archive path it came from.
+func recordQuarantine(dest, name, archivePath string) error {
+	manifestPath := filepath.Join(dest, QuarantineDir, "manifest.json")
+	manifest := make(map[string]string)
+	buf, err := os.ReadFile(manifestPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(buf, &manifest); err != nil {
+			return err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+	manifest[name] = archivePath
+	buf, err = json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(manifestPath, buf, 0644)
+}
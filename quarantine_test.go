@@ -0,0 +1,92 @@
+package hpi
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSuspicious(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"maps/example.tnt", false},
+		{"maps/..example.tnt", false},
+		{"../example.tnt", true},
+		{"maps/../../example.tnt", true},
+		{"/etc/passwd", true},
+		{`..\..\autoexec.bat`, true},
+		{strings.Repeat("a", 256) + ".tnt", true},
+	}
+	for _, test := range tests {
+		if got := suspicious(test.name); got != test.want {
+			t.Errorf("suspicious(%q): Got %v, wanted %v", test.name, got, test.want)
+		}
+	}
+}
+func TestQuarantine(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed := map[string]string{
+		"Copyright.txt":    "../../Copyright.txt",
+		"maps/example.ota": "maps/" + strings.Repeat("x", 300) + ".ota",
+	}
+	a.Options.Rename = func(name string) string {
+		if to, ok := renamed[name]; ok {
+			return to
+		}
+		return name
+	}
+	a.Options.Quarantine = true
+	root := t.TempDir()
+	dest := filepath.Join(root, "a", "b")
+	if _, err := a.ExtractMapped(dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "Copyright.txt")); err == nil {
+		t.Error("a file escaped the destination")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "maps", "example.tnt")); err != nil {
+		t.Error(err)
+	}
+	buf, err := os.ReadFile(filepath.Join(dest, QuarantineDir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest map[string]string
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != len(renamed) {
+		t.Fatalf("Got %v, wanted %d entries", manifest, len(renamed))
+	}
+	for name, archivePath := range manifest {
+		if _, ok := renamed[archivePath]; !ok {
+			t.Errorf("%s: unexpected archive path %q", name, archivePath)
+		}
+		data, err := os.ReadFile(filepath.Join(dest, QuarantineDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if archivePath == "Copyright.txt" && string(data) != "Copyright 1998 Cavedog Entertainment" {
+			t.Errorf("Got %q for %s", data, archivePath)
+		}
+	}
+	a.Options.Quarantine = false
+	if _, err := a.ExtractMapped(filepath.Join(root, "c", "d")); err == nil {
+		t.Error("expected an error for a path that escapes the destination")
+	}
+	if _, err := os.Stat(filepath.Join(root, "Copyright.txt")); err == nil {
+		t.Error("a file escaped the destination")
+	}
+}
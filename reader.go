@@ -0,0 +1,298 @@
+package hpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// OpenFile returns a reader for the contents of the file described by fd.
+// Chunks are read one at a time as the reader is read, so memory use stays
+// around one chunk however large the file is. LZ77 chunks are decoded
+// through NewDecompressor as their bytes are asked for, so only their
+// compressed data is held; other chunks are decoded whole. Errors
+// reading or decoding a chunk are returned by Read, as is an error wrapping
+// io.ErrUnexpectedEOF if the chunks decode to fewer than fd.FileSize bytes,
+// or one as soon as they decode to more. The chunk size table is read
+// before OpenFile returns.
+func OpenFile(archive io.ReaderAt, key byte, fd FileData) (io.ReadCloser, error) {
+	d := decoder{archive: archive, key: key, chunkSize: MaxChunkSize}
+	sizes, err := d.chunkSizes(fd)
+	if err != nil {
+		return nil, fmt.Errorf("chunk size table: %w", err)
+	}
+	return &fileReader{
+		d:      d,
+		size:   int64(fd.FileSize),
+		sizes:  sizes,
+		offset: int(fd.DataOffset) + ChunkTableEntrySize*len(sizes),
+	}, nil
+}
+
+// ReadChunks reads every chunk of the file described by fd without
+// decompressing any of them, for callers that handle chunks themselves.
+// Both the archive's encryption and each chunk's own are removed from the
+// returned data, so Checksum no longer applies to it, but the headers are
+// otherwise as stored. Use DecompressChunk to decode the data.
+func ReadChunks(archive io.ReaderAt, key byte, fd FileData) ([]Chunk, error) {
+	d := decoder{archive: archive, key: key, chunkSize: MaxChunkSize}
+	chunks, err := d.chunks(fd)
+	if err != nil {
+		return nil, err
+	}
+	for i := range chunks {
+		if int(chunks[i].CompressedSize) > len(chunks[i].Data) {
+			return nil, fmt.Errorf("chunk %d: compressed size %d is larger than the chunk", i, chunks[i].CompressedSize)
+		}
+		chunks[i].Data = chunks[i].Data[:chunks[i].CompressedSize]
+		if chunks[i].Encrypted != 0 {
+			chunks[i].Decrypt()
+		}
+	}
+	return chunks, nil
+}
+
+// DecompressChunk decodes the data of a chunk from ReadChunks with its
+// CompressionMethod, checking that it comes to DecompressedSize bytes,
+// which must be no more than MaxChunkSize.
+func DecompressChunk(c Chunk) ([]byte, error) {
+	if err := checkDecompressedSize(c.ChunkHeader, MaxChunkSize); err != nil {
+		return nil, err
+	}
+	data, err := decodeMethod(c.CompressionMethod, c.Data, int(c.DecompressedSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(c.DecompressedSize) {
+		return nil, fmt.Errorf("decoded to %d bytes, wanted %d", len(data), c.DecompressedSize)
+	}
+	return data, nil
+}
+
+// fileReader is the reader returned by OpenFile.
+type fileReader struct {
+	d       decoder
+	size    int64     // Decompressed size of the file.
+	decoded int64     // Bytes decoded so far.
+	sizes   []uint32  // Stored sizes of the chunks not yet read.
+	offset  int       // Archive offset of the next chunk.
+	chunk   int       // Index of the current chunk, for errors.
+	cur     io.Reader // The current chunk's data not yet returned, or nil.
+	err     error
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, r.err
+	}
+	for {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.cur == nil {
+			if len(r.sizes) == 0 {
+				if r.decoded < r.size {
+					r.err = fmt.Errorf("decoded %d bytes, wanted %d: %w", r.decoded, r.size, io.ErrUnexpectedEOF)
+					return 0, r.err
+				}
+				return 0, io.EOF
+			}
+			if r.cur, r.err = r.next(); r.err != nil {
+				r.err = fmt.Errorf("chunk %d: %w", r.chunk, r.err)
+				return 0, r.err
+			}
+		}
+		n, err := r.cur.Read(p)
+		if r.decoded += int64(n); r.decoded > r.size {
+			r.err = fmt.Errorf("chunk %d: decoded past %d bytes", r.chunk, r.size)
+			return 0, r.err
+		}
+		if err == io.EOF {
+			r.cur, err = nil, nil
+			r.chunk++
+		}
+		if err != nil {
+			// The bytes before the error are still returned.
+			r.err = fmt.Errorf("chunk %d: %w", r.chunk, err)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// next reads the next chunk and returns a reader of its decoded data,
+// which for LZ77 chunks is decoded as it is read.
+func (r *fileReader) next() (io.Reader, error) {
+	size := int(r.sizes[0])
+	r.sizes = r.sizes[1:]
+	chunk, err := r.d.readChunkAt(size, r.offset)
+	r.offset += size
+	if err != nil {
+		return nil, err
+	}
+	if chunk.CompressionMethod == 1 {
+		return NewDecompressor(bytes.NewReader(chunk.Data), int(chunk.DecompressedSize)), nil
+	}
+	data, err := DecompressChunk(chunk)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// decodeChunkAt reads the chunk of the given stored size at offset in the
+// archive and decodes it.
+func (d decoder) decodeChunkAt(size, offset int) ([]byte, error) {
+	chunk, err := d.readChunkAt(size, offset)
+	if err != nil {
+		return nil, err
+	}
+	return DecompressChunk(chunk)
+}
+
+// readChunkAt reads the chunk of the given stored size at offset in the
+// archive, checks its header and removes its encryption, leaving its data
+// to be decoded.
+func (d decoder) readChunkAt(size, offset int) (Chunk, error) {
+	headerSize := binary.Size(ChunkHeader{})
+	if size < headerSize {
+		return Chunk{}, fmt.Errorf("size %d is smaller than its header", size)
+	}
+	buf, err := d.read(size, offset)
+	if err != nil {
+		return Chunk{}, err
+	}
+	var chunk Chunk
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &chunk.ChunkHeader); err != nil {
+		return Chunk{}, err
+	}
+	if int(chunk.CompressedSize) > size-headerSize {
+		return Chunk{}, fmt.Errorf("compressed size %d is larger than the chunk", chunk.CompressedSize)
+	}
+	if err := checkDecompressedSize(chunk.ChunkHeader, d.chunkSize); err != nil {
+		return Chunk{}, err
+	}
+	chunk.Data = buf[headerSize : headerSize+int(chunk.CompressedSize)]
+	if chunk.Encrypted != 0 {
+		chunk.Decrypt()
+	}
+	return chunk, nil
+}
+
+// Close releases the reader. It does not close the archive.
+func (r *fileReader) Close() error {
+	r.cur, r.sizes = nil, nil
+	if r.err == nil {
+		r.err = fmt.Errorf("read of closed file")
+	}
+	return nil
+}
+
+// FileReaderAt gives random access to the contents of a file in an archive.
+// Every chunk but the last decompresses to the same size, so ReadAt only
+// decodes the chunks that hold the bytes asked for. The most recently used
+// chunks are kept decoded, so reads close to each other, as when a format
+// with its own index is parsed, seldom decode a chunk twice. It is safe for
+// concurrent use.
+type FileReaderAt struct {
+	d       decoder
+	size    int64
+	offsets []int // Archive offset of each chunk.
+	sizes   []int // Stored size of each chunk.
+
+	mu     sync.Mutex
+	cached int
+	cache  []cachedChunk // Most recently used first.
+}
+
+// cachedChunk is a chunk decoded by FileReaderAt.
+type cachedChunk struct {
+	index int
+	data  []byte
+}
+
+// NewFileReaderAt returns a FileReaderAt for the file described by fd that
+// keeps up to cached chunks decoded, or 4 if cached is less than one. The
+// chunk size table is read before NewFileReaderAt returns.
+func NewFileReaderAt(archive io.ReaderAt, key byte, fd FileData, cached int) (*FileReaderAt, error) {
+	if cached < 1 {
+		cached = 4
+	}
+	d := decoder{archive: archive, key: key, chunkSize: MaxChunkSize}
+	sizes, err := d.chunkSizes(fd)
+	if err != nil {
+		return nil, fmt.Errorf("chunk size table: %w", err)
+	}
+	r := &FileReaderAt{d: d, size: int64(fd.FileSize), cached: cached}
+	offset := int(fd.DataOffset) + ChunkTableEntrySize*len(sizes)
+	for _, size := range sizes {
+		r.offsets = append(r.offsets, offset)
+		r.sizes = append(r.sizes, int(size))
+		offset += int(size)
+	}
+	return r, nil
+}
+
+// Size returns the decompressed size of the file.
+func (r *FileReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes of the decompressed file starting at off. As
+// io.ReaderAt requires, it returns an error whenever it reads fewer than
+// len(p) bytes, which is io.EOF at the end of the file.
+func (r *FileReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		i := int(pos / int64(r.d.chunkSize))
+		data, err := r.chunk(i)
+		if err != nil {
+			return n, fmt.Errorf("chunk %d: %w", i, err)
+		}
+		n += copy(p[n:], data[pos-int64(i)*int64(r.d.chunkSize):])
+	}
+	return n, nil
+}
+
+// chunk returns chunk i decoded, from the cache if it is there.
+func (r *FileReaderAt) chunk(i int) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for j, c := range r.cache {
+		if c.index == i {
+			copy(r.cache[1:j+1], r.cache[:j])
+			r.cache[0] = c
+			return c.data, nil
+		}
+	}
+	if i >= len(r.sizes) {
+		return nil, fmt.Errorf("past the last of %d chunks", len(r.sizes))
+	}
+	data, err := r.d.decodeChunkAt(r.sizes[i], r.offsets[i])
+	if err != nil {
+		return nil, err
+	}
+	want := r.size - int64(i)*int64(r.d.chunkSize)
+	if want > int64(r.d.chunkSize) {
+		want = int64(r.d.chunkSize)
+	}
+	if int64(len(data)) != want {
+		return nil, fmt.Errorf("decoded to %d bytes, wanted %d", len(data), want)
+	}
+	if len(r.cache) < r.cached {
+		r.cache = append(r.cache, cachedChunk{})
+	}
+	copy(r.cache[1:], r.cache)
+	r.cache[0] = cachedChunk{index: i, data: data}
+	return data, nil
+}
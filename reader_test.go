@@ -0,0 +1,228 @@
+package hpi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"testing/iotest"
+)
+
+func TestOpenFile(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"maps/example.tnt", "Copyright.txt", "camps/useonly/example.tdf"} {
+		f, err := a.find(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := a.Extract(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := OpenFile(file, a.key, f.fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := iotest.TestReader(r, want); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		r.Close()
+		if _, err := r.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: expected an error reading a closed file", name)
+		}
+	}
+	// Decoding errors are returned by Read, after the chunks before them.
+	raw, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.find("maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes, err := a.decoder().chunkSizes(f.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Damage the compression method of the second chunk.
+	raw[int(f.fd.DataOffset)+4*len(sizes)+int(sizes[0])+5] ^= 0xff
+	r, err := OpenFile(bytes.NewReader(raw), a.key, f.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	n, err := io.Copy(io.Discard, r)
+	if err == nil {
+		t.Error("expected an error reading a damaged chunk")
+	}
+	if n != MaxChunkSize {
+		t.Errorf("Got %d, wanted %d", n, MaxChunkSize)
+	}
+}
+func TestOpenFileSize(t *testing.T) {
+	data := bytes.Repeat([]byte("Cavedog "), 25)
+	fd := FileData{FileSize: 100}
+	// The only chunk of a 100-byte file holds 10 bytes, and then 200.
+	r, err := OpenFile(bytes.NewReader(storedFile(data[:10], MaxChunkSize)), 0, fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || len(got) != 10 {
+		t.Errorf("Got %d bytes, %v, wanted %d, %v", len(got), err, 10, io.ErrUnexpectedEOF)
+	}
+	if r, err = OpenFile(bytes.NewReader(storedFile(data, MaxChunkSize)), 0, fd); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err == nil || len(got) != 0 {
+		t.Errorf("Got %d bytes, %v, wanted an error and no bytes", len(got), err)
+	}
+}
+func TestOpenFileStreams(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.find("maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenFile(file, a.key, f.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// The LZ77 chunk is decoded as it is read, not all at once.
+	if _, ok := r.(*fileReader).cur.(*lz77Reader); !ok {
+		t.Errorf("Got %T, wanted %T", r.(*fileReader).cur, &lz77Reader{})
+	}
+}
+func TestReadChunks(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.find("maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := a.Extract("maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := ReadChunks(file, a.key, f.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 5 {
+		t.Fatalf("Got %d chunks, wanted %d", len(chunks), 5)
+	}
+	var got []byte
+	for i, c := range chunks {
+		if c.Marker != ChunkStart || c.CompressionMethod != 1 {
+			t.Errorf("chunk %d: Got marker %x and method %d", i, c.Marker, c.CompressionMethod)
+		}
+		data, err := DecompressChunk(c)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		got = append(got, data...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("chunks do not decompress to the file")
+	}
+	chunks[0].DecompressedSize++
+	if _, err := DecompressChunk(chunks[0]); err == nil {
+		t.Error("expected an error for the wrong DecompressedSize")
+	}
+}
+func TestFileReaderAt(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.find("maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := a.Extract("maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &countingReaderAt{r: file}
+	r, err := NewFileReaderAt(counter, a.key, f.fd, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(want)) {
+		t.Errorf("Got %d, wanted %d", r.Size(), len(want))
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		off := rng.Intn(len(want))
+		p := make([]byte, rng.Intn(3*MaxChunkSize))
+		n, err := r.ReadAt(p, int64(off))
+		end := off + len(p)
+		if end > len(want) {
+			end = len(want)
+			if err != io.EOF {
+				t.Errorf("%d: Got %v, wanted %v", off, err, io.EOF)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p[:n], want[off:end]) {
+			t.Fatalf("%d bytes at %d differ", len(p), off)
+		}
+	}
+	// Both chunks spanned by this read are now cached.
+	p := make([]byte, 10)
+	r.ReadAt(p, 2*MaxChunkSize-5)
+	reads := counter.reads
+	r.ReadAt(p, 2*MaxChunkSize-5)
+	if counter.reads != reads {
+		t.Errorf("Got %d reads, wanted %d", counter.reads, reads)
+	}
+	if n, err := r.ReadAt(p, r.Size()); n != 0 || err != io.EOF {
+		t.Errorf("Got %d and %v, wanted 0 and %v", n, err, io.EOF)
+	}
+}
+
+// countingReaderAt counts the calls to ReadAt.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
@@ -0,0 +1,91 @@
+package hpi
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Sink is where extracted files are written, such as an in-memory
+// filesystem or a tar writer. Names are the paths the files would have on
+// disk: the destination joined with each file's path in the archive, using
+// the OS's separators.
+type Sink interface {
+	// Create creates the file called name, replacing any file already
+	// there. Extraction closes the file once it is written.
+	Create(name string) (io.WriteCloser, error)
+
+	// Mkdir creates the directory called name along with any missing
+	// parents. It is not an error for the directory to exist already.
+	Mkdir(name string) error
+}
+
+// sink returns the Sink to extract to, the OS filesystem unless o.Sink is
+// set.
+func (o ExtractOptions) sink() Sink {
+	if o.Sink != nil {
+		return o.Sink
+	}
+	return osSink{dirMode: o.DirMode, fileMode: o.FileMode, modTime: o.ModTime}
+}
+
+// writeFile creates the file called name through s and writes data to it.
+func writeFile(s Sink, name string, data []byte) error {
+	f, err := s.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// osSink writes to the OS filesystem. It implements Remove, so that
+// partly written files can be cleaned up.
+type osSink struct {
+	dirMode  os.FileMode // Zero means 0744.
+	fileMode os.FileMode // Zero means 0666, as with os.Create.
+	modTime  time.Time   // Set on each file when it is closed, if not zero.
+}
+
+func (s osSink) Create(name string) (io.WriteCloser, error) {
+	mode := s.fileMode
+	if mode == 0 {
+		mode = 0666
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &osFile{File: f, modTime: s.modTime}, nil
+}
+
+func (s osSink) Mkdir(name string) error {
+	mode := s.dirMode
+	if mode == 0 {
+		mode = 0744
+	}
+	return os.MkdirAll(name, mode)
+}
+
+func (s osSink) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// osFile is a file from osSink, which sets its times when closed.
+type osFile struct {
+	*os.File
+	modTime time.Time
+}
+
+func (f *osFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if f.modTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(f.Name(), f.modTime, f.modTime)
+}
@@ -0,0 +1,119 @@
+package hpi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// memSink collects extracted files in memory.
+type memSink struct {
+	files map[string]*bytes.Buffer
+	dirs  map[string]bool
+}
+
+func (s *memSink) Create(name string) (io.WriteCloser, error) {
+	buf := new(bytes.Buffer)
+	s.files[filepath.ToSlash(name)] = buf
+	return nopCloser{buf}, nil
+}
+func (s *memSink) Mkdir(name string) error {
+	s.dirs[filepath.ToSlash(name)] = true
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+func TestSink(t *testing.T) {
+	file, key, dir, offset := openDirectory(t, "Example.ufo")
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := a.ReadAllParallel(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memSink{files: make(map[string]*bytes.Buffer), dirs: make(map[string]bool)}
+	opts := ExtractOptions{Sink: sink}
+	if err := TraverseTreeOptions(context.Background(), file, dir, key, "out", offset, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.files) != len(want) {
+		t.Errorf("Got %d files, wanted %d", len(sink.files), len(want))
+	}
+	for name, data := range want {
+		got, ok := sink.files["out/"+name]
+		if !ok || !bytes.Equal(got.Bytes(), data) {
+			t.Errorf("%s: contents differ", name)
+		}
+	}
+	for _, name := range []string{"out", "out/maps", "out/camps/useonly"} {
+		if !sink.dirs[name] {
+			t.Errorf("%s: directory not created", name)
+		}
+	}
+	// Archive methods write through the sink as well.
+	a.Options.Sink = sink
+	if _, err := a.ExtractList("list", []string{"maps/example.ota"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.files["list/maps/example.ota"]; got == nil || got.Len() != 2267 {
+		t.Error("ExtractList did not write through the sink")
+	}
+}
+func TestSinkExtractors(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memSink{files: make(map[string]*bytes.Buffer), dirs: make(map[string]bool)}
+	a.Options.Sink = sink
+	manifest, err := a.ExtractObjects("objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := manifest["Copyright.txt"]
+	if got := sink.files["objects/objects/"+sum[:2]+"/"+sum[2:]]; got == nil || got.String() != "Copyright 1998 Cavedog Entertainment" {
+		t.Error("ExtractObjects did not write through the sink")
+	}
+	if err := a.ExtractSequence("sequence", ".raw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ExtractChunks("maps/example.tnt", "chunks"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"objects/manifest.json", "sequence/0001.raw", "sequence/sequence.json", "chunks/chunk_000.bin", "chunks/chunks.json"} {
+		if sink.files[name] == nil {
+			t.Errorf("%s: not written through the sink", name)
+		}
+	}
+	// On disk, the mode and time options apply as they do to Extract.
+	modTime := time.Date(1997, 9, 30, 0, 0, 0, 0, time.UTC)
+	a.Options = ExtractOptions{FileMode: 0600, ModTime: modTime}
+	dest := t.TempDir()
+	if err := a.ExtractChunks("maps/example.tnt", dest); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dest, "chunk_000.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 || !info.ModTime().Equal(modTime) {
+		t.Errorf("Got %v at %v, wanted %v at %v", info.Mode().Perm(), info.ModTime(), os.FileMode(0600), modTime)
+	}
+}
@@ -0,0 +1,97 @@
+package hpi
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Timings is a breakdown of the time spent extracting files. Set
+// ExtractOptions.Timings to have an Archive's extraction methods add to one.
+type Timings struct {
+	Read       time.Duration          // Reading from the archive.
+	Decrypt    time.Duration          // Archive and chunk decryption.
+	Decompress map[byte]time.Duration // Decoding, by compression method.
+	Write      time.Duration          // Writing the decoded output.
+}
+
+// Folded formats the timings as folded stacks, one "stack microseconds" line
+// per stage, which flamegraph tools accept directly.
+func (t *Timings) Folded() string {
+	var b strings.Builder
+	line := func(stack string, d time.Duration) {
+		fmt.Fprintf(&b, "extract;%s %d\n", stack, d.Microseconds())
+	}
+	line("read", t.Read)
+	line("decrypt", t.Decrypt)
+	methods := make([]int, 0, len(t.Decompress))
+	for m := range t.Decompress {
+		methods = append(methods, int(m))
+	}
+	sort.Ints(methods)
+	for _, m := range methods {
+		line("decompress;"+methodName(byte(m)), t.Decompress[byte(m)])
+	}
+	line("write", t.Write)
+	return b.String()
+}
+
+// methodName returns a short name for a chunk compression method.
+func methodName(method byte) string {
+	switch method {
+	case 0:
+		return "none"
+	case 1:
+		return "lz77"
+	case 2:
+		return "zlib"
+	}
+	return fmt.Sprintf("method%d", method)
+}
+
+func (t *Timings) addRead(start time.Time) {
+	if t != nil {
+		t.Read += time.Since(start)
+	}
+}
+
+func (t *Timings) addDecrypt(start time.Time) {
+	if t != nil {
+		t.Decrypt += time.Since(start)
+	}
+}
+
+// written returns the time spent writing so far.
+func (t *Timings) written() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return t.Write
+}
+
+// addDecompress records the time since start, less any time spent writing
+// since written was taken, as decompression with method.
+func (t *Timings) addDecompress(method byte, start time.Time, written time.Duration) {
+	if t == nil {
+		return
+	}
+	if t.Decompress == nil {
+		t.Decompress = make(map[byte]time.Duration)
+	}
+	t.Decompress[method] += time.Since(start) - (t.Write - written)
+}
+
+// timedWriter adds the time spent in Write to Timings.Write.
+type timedWriter struct {
+	w io.Writer
+	t *Timings
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.w.Write(p)
+	w.t.Write += time.Since(start)
+	return n, err
+}
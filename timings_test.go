@@ -0,0 +1,46 @@
+package hpi
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimings(t *testing.T) {
+	for _, fixture := range []string{"Example.ufo", "TADEMO.ufo"} {
+		file, err := os.Open(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		a, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var timings Timings
+		a.Options.Timings = &timings
+		if _, err := a.ExtractMapped(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		if timings.Read <= 0 || timings.Write <= 0 {
+			t.Errorf("%s: missing read or write time: %+v", fixture, timings)
+		}
+		if len(timings.Decompress) != 1 {
+			t.Errorf("%s: Got %v, wanted one compression method", fixture, timings.Decompress)
+		}
+		folded := timings.Folded()
+		for _, stack := range []string{"extract;read ", "extract;decrypt ", "extract;write "} {
+			if !strings.Contains(folded, stack) {
+				t.Errorf("%s: %q is missing %q", fixture, folded, stack)
+			}
+		}
+	}
+}
+func TestTimingsFoldedMethods(t *testing.T) {
+	timings := Timings{Decompress: map[byte]time.Duration{2: 3 * time.Millisecond, 1: time.Millisecond}}
+	want := "extract;read 0\nextract;decrypt 0\nextract;decompress;lz77 1000\nextract;decompress;zlib 3000\nextract;write 0\n"
+	if got := timings.Folded(); got != want {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+}
@@ -0,0 +1,114 @@
+package hpi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Validate decodes every file in the archive without writing it anywhere,
+// checking each chunk's checksum along the way. Every failure is reported,
+// joined in directory order.
+func (a *Archive) Validate() error {
+	files, err := a.files()
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(files))
+	for i, f := range files {
+		errs[i] = a.validateFile(f)
+	}
+	return errors.Join(errs...)
+}
+
+// Verify checks the HPI file in r end to end without writing anything: the
+// header and directory are parsed, and every chunk of every file is
+// decrypted, checked against its checksum and decompressed, and each file's
+// decoded size is compared with its FileData. Every problem with a file is
+// reported, joined in directory order. Problems with the header or the
+// directory leave nothing to walk, so only those are reported.
+func Verify(r io.ReadSeeker) error {
+	a, err := Open(r)
+	if err != nil {
+		return err
+	}
+	return a.Validate()
+}
+
+// ValidateParallel is like Validate but checks up to workers files at once.
+// If workers is less than one, runtime.NumCPU() is used. The result does not
+// depend on the order in which the workers finish.
+func (a *Archive) ValidateParallel(workers int) error {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	files, err := a.files()
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(files))
+	parallel(len(files), workers, func(i int) {
+		errs[i] = a.validateFile(files[i])
+	})
+	return errors.Join(errs...)
+}
+
+// parallel calls fn for each index below n from workers goroutines and
+// waits for them to finish.
+func parallel(n, workers int, fn func(i int)) {
+	var (
+		jobs = make(chan int)
+		wg   sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// archiveFile is a file found while walking the directory.
+type archiveFile struct {
+	name   string
+	fd     FileData
+	offset int // Where fd is stored in the directory.
+}
+
+// files lists every file in the archive in directory order.
+func (a *Archive) files() ([]archiveFile, error) {
+	var files []archiveFile
+	err := a.walk(func(name string, _ int, e Entry) error {
+		if e.Flag == 1 {
+			return nil
+		}
+		fd, err := a.fileData(int(e.DirDataOffset))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		files = append(files, archiveFile{name: name, fd: fd, offset: int(e.DirDataOffset)})
+		return nil
+	})
+	return files, err
+}
+
+// validateFile decodes f with checksums enabled and discards the output.
+func (a *Archive) validateFile(f archiveFile) error {
+	d := a.decoder()
+	d.verify = true
+	d.timings = nil // Timings is not safe for ValidateParallel's workers.
+	if err := d.decodeFile(f.fd, io.Discard); err != nil {
+		return fmt.Errorf("%s: %w", f.name, err)
+	}
+	return nil
+}
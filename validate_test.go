@@ -0,0 +1,88 @@
+package hpi
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := a.ValidateParallel(4); err != nil {
+		t.Error(err)
+	}
+}
+func TestValidateParallelCorrupt(t *testing.T) {
+	buf, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte inside the chunk data of Copyright.txt and example.ota.
+	buf[250] ^= 0xff
+	buf[125090] ^= 0xff
+	a, err := Open(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := a.Validate()
+	if serial == nil {
+		t.Fatal("expected checksum errors")
+	}
+	for _, name := range []string{"Copyright.txt", "maps/example.ota"} {
+		if !strings.Contains(serial.Error(), name) {
+			t.Errorf("error %q does not mention %s", serial, name)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		parallel := a.ValidateParallel(3)
+		if parallel == nil || parallel.Error() != serial.Error() {
+			t.Errorf("Got %v, wanted %v", parallel, serial)
+		}
+	}
+}
+func TestVerify(t *testing.T) {
+	buf, err := os.ReadFile("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(bytes.NewReader(buf)); err != nil {
+		t.Error(err)
+	}
+	// Damage the chunk data of Copyright.txt and example.ota, and the
+	// compression method of example.tnt's first chunk.
+	buf[250] ^= 0xff
+	buf[125090] ^= 0xff
+	a, err := Open(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.find("maps/example.tnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[int(f.fd.DataOffset)+4*5+5] ^= 0xff
+	err = Verify(bytes.NewReader(buf))
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, name := range []string{"Copyright.txt", "maps/example.ota", "maps/example.tnt"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not mention %s", err, name)
+		}
+	}
+	if err := Verify(bytes.NewReader(buf[:100])); err == nil {
+		t.Error("expected an error for a truncated archive")
+	}
+}
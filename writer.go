@@ -0,0 +1,548 @@
+package hpi
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Writer creates an HPI archive. Each file's data is written out as soon as
+// the file is added, so only the directory is held in memory. To make that
+// possible the directory is written last, into space reserved for it at the
+// start of the archive; see DirectoryReserve. Writer is the write side of the
+// package and cannot read archives back; use Open for that.
+type Writer struct {
+	// DirectoryReserve is how many bytes after the header are set aside
+	// for the directory. It must be set before the first file is added.
+	// Each file needs 18 bytes plus its name, and each directory 17 bytes
+	// plus its name. If the directory outgrows the reservation, Close
+	// writes it after the file data instead, which is valid but makes
+	// readers that allocate Header.DirectorySize bytes use far more memory.
+	DirectoryReserve int
+
+	w       io.WriteSeeker
+	key     byte
+	files   []writerFile
+	names   map[string]bool
+	base    int64 // Position of w where the archive begins.
+	next    int   // Archive offset where the next file's data goes.
+	started bool  // Whether any file data has been written.
+	closed  bool
+}
+
+// DefaultDirectoryReserve is the DirectoryReserve of a new Writer, which is
+// enough for a directory of a couple of thousand files.
+const DefaultDirectoryReserve = 64 * 1024
+
+// writerFile is a file whose data has been written and that Close lists in
+// the directory.
+type writerFile struct {
+	name   string
+	size   uint32 // Decompressed size.
+	flag   byte   // FileData.Flag.
+	offset uint32 // FileData.DataOffset.
+}
+
+// NewWriter returns a Writer that encrypts the archive it writes to w with
+// key. A key of 0 leaves the archive unencrypted. The archive begins at the
+// current position of w, which must support seeking back to backfill the
+// header and directory.
+func NewWriter(w io.WriteSeeker, key byte) *Writer {
+	return &Writer{
+		DirectoryReserve: DefaultDirectoryReserve,
+		w:                w,
+		key:              key,
+		names:            make(map[string]bool),
+	}
+}
+
+// CopyFile copies the named file from src into dst without decompressing
+// it. The chunks keep their exact compressed bytes and are only re-encrypted
+// with dst's key.
+func CopyFile(dst *Writer, src *Archive, name string) error {
+	f, err := src.find(name)
+	if err != nil {
+		return err
+	}
+	data, err := src.decoder().rawFile(f.fd)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return dst.add(writerFile{
+		name: f.name,
+		size: f.fd.FileSize,
+		flag: f.fd.Flag,
+	}, data)
+}
+
+// Repack writes a copy of the archive in src to dst, passing each file
+// through transform on the way. transform is called in directory order with
+// each file's path and contents and returns the contents to write, and
+// false to leave the file out. Files keep their compression method and the
+// new archive is encrypted with the same key. Every file is recompressed,
+// so use CopyFile to copy files unchanged when speed matters.
+func Repack(src io.ReadSeeker, dst io.WriteSeeker, transform func(path string, data []byte) ([]byte, bool)) error {
+	a, err := Open(src)
+	if err != nil {
+		return err
+	}
+	files, err := a.files()
+	if err != nil {
+		return err
+	}
+	w := NewWriter(dst, a.key)
+	for _, f := range files {
+		data, err := a.ReadFileAt(f.fd)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		data, keep := transform(f.name, data)
+		if !keep {
+			continue
+		}
+		if err := w.AddFile(f.name, data, f.fd.Flag); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// AddFile compresses data with method, 0 for none, 1 for LZ77 or 2 for
+// zlib, and adds it to the archive as name, a slash-separated path. A name
+// that this package would refuse to extract, such as one with an empty,
+// "." or ".." component or a backslash, is rejected. Directories are
+// created as needed. The data is split into chunks of 65536
+// bytes, each compressed on its own, and written out before AddFile returns.
+func (w *Writer) AddFile(name string, data []byte, method byte) error {
+	stored, err := encodeFile(data, method)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return w.add(writerFile{
+		name: name,
+		size: uint32(len(data)),
+		flag: method,
+	}, stored)
+}
+
+// encodeFile returns data as it is stored in an archive before archive
+// encryption: the chunk size table followed by the chunks compressed with
+// method.
+func encodeFile(data []byte, method byte) ([]byte, error) {
+	var table, chunks bytes.Buffer
+	for len(data) > 0 {
+		n := len(data)
+		if n > MaxChunkSize {
+			n = MaxChunkSize
+		}
+		chunk, err := encodeChunk(data[:n], method)
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&table, binary.LittleEndian, uint32(len(chunk)))
+		chunks.Write(chunk)
+		data = data[n:]
+	}
+	return append(table.Bytes(), chunks.Bytes()...), nil
+}
+
+// encodeChunk returns data compressed with method as a chunk, header
+// included, before archive encryption.
+func encodeChunk(data []byte, method byte) ([]byte, error) {
+	compressed, err := compressChunk(data, method)
+	if err != nil {
+		return nil, err
+	}
+	chunk := Chunk{
+		ChunkHeader: ChunkHeader{
+			Marker:            ChunkStart,
+			CompressionMethod: method,
+			CompressedSize:    uint32(len(compressed)),
+			DecompressedSize:  uint32(len(data)),
+		},
+		Data: compressed,
+	}
+	chunk.ChunkHeader.Checksum = chunk.Checksum()
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, chunk.ChunkHeader)
+	// The byte after the marker is 2 in the archives Cavedog shipped.
+	buf.Bytes()[4] = 2
+	buf.Write(compressed)
+	return buf.Bytes(), nil
+}
+
+// AddFileReader is AddFile for data read from r. The data is read,
+// compressed and written one chunk at a time. The chunk size table comes
+// before the chunks, so their number must be known before the first is
+// written: when r has a Len method, as *bytes.Reader and *strings.Reader
+// do, or is an io.Seeker such as *os.File, only one chunk is held in memory.
+// Otherwise the compressed chunks are held until r is exhausted, and
+// written out then.
+func (w *Writer) AddFileReader(name string, r io.Reader, method byte) error {
+	size, ok := readerSize(r)
+	if !ok {
+		return w.addBuffered(name, r, method)
+	}
+	if size > math.MaxUint32 {
+		return fmt.Errorf("%s: %d bytes is too large for an HPI file", name, size)
+	}
+	if err := w.begin(name); err != nil {
+		return err
+	}
+	var (
+		offset = w.next
+		table  = make([]byte, ChunkTableEntrySize*chunkCount(uint32(size), MaxChunkSize))
+		pos    = offset + len(table)
+		buf    = make([]byte, MaxChunkSize)
+		read   int64
+	)
+	if _, err := w.w.Seek(w.base+int64(pos), io.SeekStart); err != nil {
+		return err
+	}
+	for i := 0; i < len(table)/ChunkTableEntrySize; i++ {
+		n, err := io.ReadFull(r, buf[:minInt64(size-read, MaxChunkSize)])
+		if err != nil {
+			return w.abandon(fmt.Errorf("%s: read %d of %d bytes: %w", name, read+int64(n), size, err))
+		}
+		read += int64(n)
+		chunk, err := encodeChunk(buf[:n], method)
+		if err != nil {
+			return w.abandon(fmt.Errorf("%s: %w", name, err))
+		}
+		if err := w.writeEncrypted(chunk, pos); err != nil {
+			return w.abandon(err)
+		}
+		binary.LittleEndian.PutUint32(table[ChunkTableEntrySize*i:], uint32(len(chunk)))
+		pos += len(chunk)
+	}
+	if n, _ := r.Read(buf[:1]); n > 0 {
+		return w.abandon(fmt.Errorf("%s: more than the %d bytes expected", name, size))
+	}
+	if _, err := w.w.Seek(w.base+int64(offset), io.SeekStart); err != nil {
+		return w.abandon(err)
+	}
+	if err := w.writeEncrypted(table, offset); err != nil {
+		return w.abandon(err)
+	}
+	if _, err := w.w.Seek(w.base+int64(pos), io.SeekStart); err != nil {
+		return w.abandon(err)
+	}
+	w.next = pos
+	w.record(writerFile{name: name, size: uint32(size), flag: method, offset: uint32(offset)})
+	return nil
+}
+
+// addBuffered is AddFileReader for a reader whose length is not known.
+func (w *Writer) addBuffered(name string, r io.Reader, method byte) error {
+	var (
+		table, chunks bytes.Buffer
+		buf           = make([]byte, MaxChunkSize)
+		size          int64
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			chunk, err := encodeChunk(buf[:n], method)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			binary.Write(&table, binary.LittleEndian, uint32(len(chunk)))
+			chunks.Write(chunk)
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if size > math.MaxUint32 {
+		return fmt.Errorf("%s: %d bytes is too large for an HPI file", name, size)
+	}
+	return w.add(writerFile{
+		name: name,
+		size: uint32(size),
+		flag: method,
+	}, append(table.Bytes(), chunks.Bytes()...))
+}
+
+// readerSize returns how many bytes are left to read from r, if that can
+// be told without reading them.
+func readerSize(r io.Reader) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	case io.Seeker:
+		cur, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, false
+		}
+		if _, err := r.Seek(cur, io.SeekStart); err != nil {
+			return 0, false
+		}
+		return end - cur, true
+	}
+	return 0, false
+}
+
+// minInt64 returns the smaller of a and b.
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// compressChunk compresses the data of one chunk with method.
+func compressChunk(data []byte, method byte) ([]byte, error) {
+	switch method {
+	case 0:
+		return data, nil
+	case 1:
+		return Compress(data), nil
+	case 2:
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("cannot compress with method %x", method)
+}
+
+// add writes data, the chunk size table and chunks of f before archive
+// encryption, and records f for the directory.
+func (w *Writer) add(f writerFile, data []byte) error {
+	if err := w.begin(f.name); err != nil {
+		return err
+	}
+	f.offset = uint32(w.next)
+	if err := w.writeEncrypted(data, w.next); err != nil {
+		return w.abandon(err)
+	}
+	w.next += len(data)
+	w.record(f)
+	return nil
+}
+
+// begin checks that a file called name can be added and, for the first
+// file, reserves space for the header and directory. w is then positioned
+// at w.next.
+func (w *Writer) begin(name string) error {
+	if w.closed {
+		return fmt.Errorf("write to closed archive")
+	}
+	if !validName(name) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if w.names[strings.ToLower(name)] {
+		return fmt.Errorf("%s: duplicate file", name)
+	}
+	if !w.started {
+		base, err := w.w.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		w.base = base
+		w.next = binary.Size(Header{}) + w.DirectoryReserve
+		if _, err := w.w.Seek(w.base+int64(w.next), io.SeekStart); err != nil {
+			return err
+		}
+		w.started = true
+	}
+	return nil
+}
+
+// validName reports whether name can be stored as a slash-separated path
+// that this package reads and extracts back as it is: every component is
+// non-empty, not "." or "..", no longer than maxNameLength, and free of
+// backslashes, which are separators to TA, and of the NUL that ends a name.
+func validName(name string) bool {
+	if unsafePath(name) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || len(part) > maxNameLength || strings.ContainsAny(part, "\\\x00") {
+			return false
+		}
+	}
+	return true
+}
+
+// record lists f, whose data has been written, in the directory.
+func (w *Writer) record(f writerFile) {
+	w.names[strings.ToLower(f.name)] = true
+	w.files = append(w.files, f)
+}
+
+// abandon returns err after moving w back to w.next, so that the next file
+// is written over whatever part of a failed one was written.
+func (w *Writer) abandon(err error) error {
+	w.w.Seek(w.base+int64(w.next), io.SeekStart)
+	return err
+}
+
+// treeNode is a directory or file in the tree that Close lays out.
+type treeNode struct {
+	name     string
+	file     int // Index into Writer.files, or -1 for directories.
+	children []*treeNode
+}
+
+// child returns the child directory called name, creating it if needed.
+func (n *treeNode) child(name string) (*treeNode, error) {
+	for _, c := range n.children {
+		if strings.EqualFold(c.name, name) {
+			if c.file >= 0 {
+				return nil, fmt.Errorf("%s is both a file and a directory", name)
+			}
+			return c, nil
+		}
+	}
+	c := &treeNode{name: name, file: -1}
+	n.children = append(n.children, c)
+	return c, nil
+}
+
+// Close backfills the directory and header and leaves w positioned at the
+// end of the archive. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	root := &treeNode{file: -1}
+	for i, f := range w.files {
+		parts := strings.Split(f.name, "/")
+		dir := root
+		for _, part := range parts[:len(parts)-1] {
+			var err error
+			if dir, err = dir.child(part); err != nil {
+				return err
+			}
+		}
+		leaf := parts[len(parts)-1]
+		for _, c := range dir.children {
+			if strings.EqualFold(c.name, leaf) {
+				return fmt.Errorf("%s is both a file and a directory", f.name)
+			}
+		}
+		dir.children = append(dir.children, &treeNode{name: leaf, file: i})
+	}
+	if !w.started {
+		base, err := w.w.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		w.base = base
+	}
+	var (
+		header Header
+		start  = binary.Size(header)
+		end    = start // End of the archive.
+	)
+	directory := w.directory(root, start)
+	if w.started {
+		end = w.next
+		if len(directory) > w.DirectoryReserve {
+			start = w.next
+			directory = w.directory(root, start)
+		}
+	}
+	if start+len(directory) > end {
+		end = start + len(directory)
+	}
+	header = Header{
+		Marker:        HPIMagic,
+		Save:          Version1,
+		DirectorySize: uint32(start + len(directory)),
+		Key:           KeyToHeaderField(w.key),
+		Start:         uint32(start),
+	}
+	if _, err := w.w.Seek(w.base, io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Write(w.w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if _, err := w.w.Seek(w.base+int64(start), io.SeekStart); err != nil {
+		return err
+	}
+	if err := w.writeEncrypted(directory, start); err != nil {
+		return err
+	}
+	_, err := w.w.Seek(w.base+int64(end), io.SeekStart)
+	return err
+}
+
+// directory lays out the directory tree under root as it is stored at
+// offset start, with each file's FileData filled in.
+func (w *Writer) directory(root *treeNode, start int) []byte {
+	var buf bytes.Buffer
+	fds := make([]int, len(w.files))
+	layoutDirectory(&buf, uint32(start), root, fds)
+	directory := buf.Bytes()
+	for i, f := range w.files {
+		fd := FileData{DataOffset: f.offset, FileSize: f.size, Flag: f.flag}
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, fd)
+		copy(directory[fds[i]:], b.Bytes())
+	}
+	return directory
+}
+
+// layoutDirectory appends the directory n to buf, which begins at offset
+// start in the archive. Space is left for each file's FileData, and its
+// position in buf is recorded in fds.
+func layoutDirectory(buf *bytes.Buffer, start uint32, n *treeNode, fds []int) {
+	sort.SliceStable(n.children, func(i, j int) bool {
+		return strings.ToLower(n.children[i].name) < strings.ToLower(n.children[j].name)
+	})
+	pos := func() uint32 { return start + uint32(buf.Len()) }
+	entryOffset := pos() + 8
+	binary.Write(buf, binary.LittleEndian, uint32(len(n.children)))
+	binary.Write(buf, binary.LittleEndian, entryOffset)
+	buf.Write(make([]byte, 9*len(n.children)))
+	for i, c := range n.children {
+		entry := Entry{NameOffset: pos()}
+		buf.WriteString(c.name)
+		buf.WriteByte(0)
+		entry.DirDataOffset = pos()
+		if c.file < 0 {
+			entry.Flag = 1
+			layoutDirectory(buf, start, c, fds)
+		} else {
+			fds[c.file] = buf.Len()
+			buf.Write(make([]byte, binary.Size(FileData{})))
+		}
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, entry)
+		copy(buf.Bytes()[int(entryOffset-start)+9*i:], b.Bytes())
+	}
+}
+
+// writeEncrypted writes buf as it would be stored at offset in the archive.
+func (w *Writer) writeEncrypted(buf []byte, offset int) error {
+	if w.key != 0 {
+		enc := make([]byte, len(buf))
+		copy(enc, buf)
+		DecryptInPlace(enc, w.key, offset)
+		buf = enc
+	}
+	_, err := w.w.Write(buf)
+	return err
+}
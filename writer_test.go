@@ -0,0 +1,530 @@
+package hpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCopyFile(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	src, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(filepath.Join(t.TempDir(), "copy.hpi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	names := []string{"maps/example.tnt", "Copyright.txt", "camps/useonly/example.tdf", "maps/example.ota"}
+	w := NewWriter(out, 0x5a)
+	for _, name := range names {
+		if err := CopyFile(w, src, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CopyFile(w, src, "Copyright.txt"); err == nil {
+		t.Error("expected an error copying a file twice")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.key != 0x5a {
+		t.Errorf("Got %x, wanted %x", dst.key, 0x5a)
+	}
+	if err := dst.Validate(); err != nil {
+		t.Error(err)
+	}
+	for _, name := range names {
+		want, err := src.find(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dst.find(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantData, err := src.ReadFileAt(want.fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotData, err := dst.ReadFileAt(got.fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gotData, wantData) {
+			t.Errorf("%s: contents differ after copy", name)
+		}
+	}
+}
+func TestWriterDirectoryReserve(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	src, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reserve := range []int{DefaultDirectoryReserve, 16} {
+		out, err := os.Create(filepath.Join(t.TempDir(), "reserve.hpi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The archive starts after some unrelated data.
+		if _, err := out.WriteString("stub"); err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(out, 0x21)
+		w.DirectoryReserve = reserve
+		for _, name := range []string{"Copyright.txt", "maps/example.ota"} {
+			if err := CopyFile(w, src, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		end, err := out.Seek(0, io.SeekCurrent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := out.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end != info.Size() {
+			t.Errorf("reserve %d: writer left at %d, wanted the end at %d", reserve, end, info.Size())
+		}
+		dst, err := Open(io.NewSectionReader(out, 4, info.Size()-4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reserve == 16 && dst.header.Start < uint32(reserve) {
+			t.Errorf("Got directory at %d, wanted it after the data", dst.header.Start)
+		}
+		if err := dst.Validate(); err != nil {
+			t.Errorf("reserve %d: %v", reserve, err)
+		}
+		data, err := dst.FirstChunk("Copyright.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Copyright 1998 Cavedog Entertainment"; string(data) != want {
+			t.Errorf("Got %q, wanted %q", data, want)
+		}
+		out.Close()
+	}
+}
+func TestWriterDirectoryAfterData(t *testing.T) {
+	// With no reserve the directory goes after the file data, so its root
+	// is not right after the header.
+	out, err := os.Create(filepath.Join(t.TempDir(), "after.hpi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	want := []byte("Copyright 1998 Cavedog Entertainment")
+	w := NewWriter(out, 0x21)
+	w.DirectoryReserve = 0
+	if err := w.AddFile("gamedata/Copyright.txt", want, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	header, key, dir, err := LoadDirectory(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := int(header.Start)
+	if start == binary.Size(header) {
+		t.Fatalf("Got the directory at %d, wanted it after the data", start)
+	}
+	fd, ok, err := FindEntry(dir, key, start, `GAMEDATA\copyright.txt`)
+	if err != nil || !ok || fd.FileSize != uint32(len(want)) {
+		t.Errorf("FindEntry: Got %v, %v, %v, wanted a file of %d bytes", fd, ok, err, len(want))
+	}
+	if fd, err := Stat(dir, key, start, "gamedata/Copyright.txt"); err != nil || fd.FileSize != uint32(len(want)) {
+		t.Errorf("Stat: Got %v, %v, wanted a file of %d bytes", fd, err, len(want))
+	}
+	data, err := ExtractPath(out, dir, key, start, "gamedata/copyright.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("Got %q, wanted %q", data, want)
+	}
+}
+func TestAddFile(t *testing.T) {
+	big := make([]byte, 200000)
+	for i := range big {
+		big[i] = byte(i*i>>7) ^ byte(i>>11)
+	}
+	files := []struct {
+		name   string
+		data   []byte
+		method byte
+	}{
+		{"Copyright.txt", []byte("Copyright 1998 Cavedog Entertainment"), 0},
+		{"maps/big.tnt", big, 2},
+		{"maps/stored.tnt", big[:MaxChunkSize+1], 0},
+		{"maps/lz77.tnt", big[:100000], 1},
+		{"camps/useonly/empty.tdf", nil, 2},
+	}
+	out, err := os.Create(filepath.Join(t.TempDir(), "new.hpi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := NewWriter(out, 0x3c)
+	for _, f := range files {
+		if err := w.AddFile(f.name, f.data, f.method); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.AddFile("bad.tnt", big, 0x7f); err == nil {
+		t.Error("expected an error for an unknown method")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		data, err := a.Extract(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, f.data) {
+			t.Errorf("%s: contents differ", f.name)
+		}
+	}
+	// The free functions read the archive as well.
+	header, key, dir, err := LoadDirectory(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := TraverseTree(out, dir, key, dest, int(header.Start)); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(f.name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, f.data) {
+			t.Errorf("%s: extracted contents differ", f.name)
+		}
+	}
+}
+func TestWriterInvalidNames(t *testing.T) {
+	out, err := os.Create(filepath.Join(t.TempDir(), "names.hpi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := NewWriter(out, 0)
+	for _, name := range []string{
+		"", "/abs.txt", "dir/", "a//b.txt", ".", "./a.txt", "../evil.txt", "maps/../../evil.txt",
+		`maps\example.ota`, "nul\x00.txt", strings.Repeat("x", 256),
+	} {
+		if err := w.AddFile(name, []byte("data"), 0); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+	if err := w.AddFile("maps/..example.ota", []byte("data"), 0); err != nil {
+		t.Errorf("Got %v, wanted a name with dots in it to be accepted", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// failingFile is a file whose writes fail, like a full disk, once limit
+// more bytes have been written, if limit is not negative.
+type failingFile struct {
+	*os.File
+	limit int
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.limit < 0 || len(p) <= f.limit {
+		if f.limit >= 0 {
+			f.limit -= len(p)
+		}
+		return f.File.Write(p)
+	}
+	n, _ := f.File.Write(p[:f.limit])
+	f.limit = -1
+	return n, fmt.Errorf("disk full")
+}
+func TestAddFileAfterFailedWrite(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "failed.hpi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	out := &failingFile{File: file, limit: -1}
+	w := NewWriter(out, 0x21)
+	big := bytes.Repeat([]byte("Total Annihilation "), 5000)
+	out.limit = 1000
+	if err := w.AddFile("a.txt", big, 0); err == nil {
+		t.Fatal("expected an error for a failed write")
+	}
+	want := []byte("Copyright 1998 Cavedog Entertainment")
+	if err := w.AddFile("b.txt", want, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.Extract("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+	if _, err := a.Extract("a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got %v, wanted %v", err, ErrNotFound)
+	}
+}
+func TestAddFileReader(t *testing.T) {
+	big := make([]byte, 200000)
+	for i := range big {
+		big[i] = byte(i*i>>7) ^ byte(i>>11)
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.tnt")
+	if err := os.WriteFile(src, big, 0666); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	in.Seek(1000, io.SeekStart)
+	files := []struct {
+		name   string
+		r      io.Reader
+		data   []byte
+		method byte
+	}{
+		{"maps/len.tnt", bytes.NewReader(big), big, 1},
+		{"maps/seeker.tnt", in, big[1000:], 2},
+		{"maps/stream.tnt", iotest.HalfReader(bytes.NewReader(big[:MaxChunkSize+1])), big[:MaxChunkSize+1], 0},
+		{"empty.tdf", strings.NewReader(""), nil, 1},
+	}
+	out, err := os.Create(filepath.Join(dir, "new.hpi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := NewWriter(out, 0x3c)
+	for _, f := range files {
+		if err := w.AddFileReader(f.name, f.r, f.method); err != nil {
+			t.Fatal(err)
+		}
+		// A failed file leaves nothing behind for the next one.
+		r := io.MultiReader(bytes.NewReader(big[:100]), iotest.ErrReader(io.ErrClosedPipe))
+		if err := w.AddFileReader("failed.tnt", r, 1); !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("Got %v, wanted %v", err, io.ErrClosedPipe)
+		}
+		// This one claims 200000 bytes and ends after 100000.
+		r = io.NewSectionReader(bytes.NewReader(big[:100000]), 0, int64(len(big)))
+		if err := w.AddFileReader("short.tnt", r, 1); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Got %v, wanted %v", err, io.ErrUnexpectedEOF)
+		}
+	}
+	if err := w.AddFileReader("maps/len.tnt", bytes.NewReader(big), 1); err == nil {
+		t.Error("expected an error for a duplicate file")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(a.List()); got != len(files) {
+		t.Errorf("Got %d files, wanted %d", got, len(files))
+	}
+	for _, f := range files {
+		data, err := a.Extract(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, f.data) {
+			t.Errorf("%s: contents differ", f.name)
+		}
+	}
+}
+func TestRepack(t *testing.T) {
+	file, err := os.Open("Example.ufo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	src, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := src.ReadAllParallel(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched := []byte("Copyright 2024 Somebody Else")
+	for _, test := range []struct {
+		name      string
+		transform func(string, []byte) ([]byte, bool)
+		want      map[string][]byte
+	}{
+		{"identity", func(_ string, data []byte) ([]byte, bool) { return data, true }, want},
+		{"patch", func(name string, data []byte) ([]byte, bool) {
+			switch name {
+			case "Copyright.txt":
+				return patched, true
+			case "maps/example.ota":
+				return nil, false
+			}
+			return data, true
+		}, map[string][]byte{
+			"Copyright.txt":             patched,
+			"maps/example.tnt":          want["maps/example.tnt"],
+			"camps/useonly/example.tdf": want["camps/useonly/example.tdf"],
+		}},
+	} {
+		out, err := os.Create(filepath.Join(t.TempDir(), "repack.hpi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		if err := Repack(file, out, test.transform); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		dst, err := Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dst.key != src.key {
+			t.Errorf("%s: Got key %x, wanted %x", test.name, dst.key, src.key)
+		}
+		got, err := dst.ReadAllParallel(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: Got %d files, wanted %d", test.name, len(got), len(test.want))
+		}
+		for name, data := range test.want {
+			if !bytes.Equal(got[name], data) {
+				t.Errorf("%s: %s differs", test.name, name)
+			}
+		}
+		infos, err := dst.FileInfos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			if info.Compression != 1 {
+				t.Errorf("%s: %s: Got method %d, wanted %d", test.name, info.Path, info.Compression, 1)
+			}
+		}
+	}
+}
+func TestUnencryptedArchive(t *testing.T) {
+	data := []byte("Copyright 1998 Cavedog Entertainment")
+	out, err := os.Create(filepath.Join(t.TempDir(), "plain.hpi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := NewWriter(out, 0)
+	for method := byte(0); method <= 2; method++ {
+		if err := w.AddFile(fmt.Sprintf("method%d.txt", method), data, method); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// With no encryption at all, stored data appears in the file as is.
+	raw, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, data) || !bytes.Contains(raw, []byte("method0.txt")) {
+		t.Error("stored data is not in the file as written")
+	}
+	header, key, dir, err := LoadDirectory(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Key != 0 || key != 0 {
+		t.Errorf("Got key %d, wanted %d", key, 0)
+	}
+	dest := t.TempDir()
+	if err := TraverseTree(out, dir, key, dest, int(header.Start)); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, plain, err := a.ChunkEncryptionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted != 0 || plain != 3 {
+		t.Errorf("Got %d encrypted and %d plain, wanted 0 and 3", encrypted, plain)
+	}
+	for method := 0; method <= 2; method++ {
+		name := fmt.Sprintf("method%d.txt", method)
+		got, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: Got %q, wanted %q", name, got, data)
+		}
+	}
+}